@@ -0,0 +1,162 @@
+// Package archive implements the multus snapshot format.  A snapshot is an
+// encrypted gzip stream holding a Header followed by a sequence of records.
+//
+// Version 1 records are laid out as:
+//
+//	u16 path length | path | 36 byte FileAttributes | u64 data length | data
+//
+// Version 2 records start with a record kind and carry length-prefixed
+// optional fields:
+//
+//	u8 kind | u16 path length | path | 36 byte FileAttributes |
+//	u32 fields length | fields | u64 data length | data
+//
+// where each field is encoded as u16 type | u32 length | value.  A version 2
+// snapshot ends with a trailer record:
+//
+//	u8 kind | u64 records | u64 data bytes | u64 new | u64 changed |
+//	u64 deleted | sha256 of everything preceding the trailer
+//
+// The trailer is protected by the stream encryption along with the rest of
+// the snapshot, so a truncated or modified file fails verification.
+//
+// Version 1 and 2 snapshots are a single encrypted gzip stream.  Version 3
+// uses the version 2 records but stores them in independently compressed and
+// encrypted blocks followed by an index, see blocks.go.  Version 4 adds the
+// creation time of the increment to the header.
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrTruncated is returned when a snapshot ends early.
+	ErrTruncated = errors.New("archive truncated")
+
+	// ErrCorrupt is returned when a snapshot does not match its trailer.
+	ErrCorrupt = errors.New("archive corrupt")
+)
+
+const (
+	// Version1 is the original, fixed record layout.  Snapshots written
+	// before the format version was recorded correctly carry version 0
+	// and use the same layout.
+	Version1 = uint16(1)
+
+	// Version2 adds record kinds and optional fields.
+	Version2 = uint16(2)
+
+	// Version3 stores version 2 records in indexed blocks.
+	Version3 = uint16(3)
+
+	// Version4 records when each increment was created.
+	Version4 = uint16(4)
+
+	// Version is the format version written by this package.
+	Version = Version4
+)
+
+const (
+	maxPathLen   = 1<<16 - 1
+	maxFieldsLen = 16 * 1024 * 1024
+)
+
+// Kind identifies the type of a record.
+type Kind uint8
+
+const (
+	// KindEntry records a new file system object along with its data.
+	KindEntry Kind = iota + 1
+
+	// KindChange records a file system object that changed since the
+	// previous increment.  The data of regular files and symlinks is an
+	// rsync delta against their previous contents.
+	KindChange
+
+	// KindDelete records the removal of a path since the previous
+	// increment.  Only the path of its Metadata is meaningful.  Version 1
+	// snapshots mark deletions with all-zero FileAttributes instead.
+	KindDelete
+
+	// KindTrailer ends a version 2 snapshot, see Trailer.
+	KindTrailer
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindEntry:
+		return "entry"
+	case KindChange:
+		return "change"
+	case KindDelete:
+		return "delete"
+	case KindTrailer:
+		return "trailer"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(k))
+}
+
+// checkVersion returns an error when the snapshot format version cannot be
+// read by this package.
+func checkVersion(version uint16) error {
+	switch version {
+	case 0, Version1, Version2, Version3, Version4:
+		return nil
+	}
+	return fmt.Errorf("unsupported format version %d (max %d)",
+		version, Version)
+}
+
+const trailerLen = 5*8 + sha256.Size
+
+// Trailer summarizes the records of a snapshot.
+type Trailer struct {
+	Records   uint64
+	DataBytes uint64
+	New       uint64
+	Changed   uint64
+	Deleted   uint64
+	Hash      [sha256.Size]byte
+}
+
+func (t *Trailer) count(kind Kind, dataLen int64) {
+	t.Records++
+	t.DataBytes += uint64(dataLen)
+	switch kind {
+	case KindEntry:
+		t.New++
+	case KindChange:
+		t.Changed++
+	case KindDelete:
+		t.Deleted++
+	}
+}
+
+func (t *Trailer) Serialize() []byte {
+	buf := make([]byte, trailerLen)
+	binary.LittleEndian.PutUint64(buf[0:8], t.Records)
+	binary.LittleEndian.PutUint64(buf[8:16], t.DataBytes)
+	binary.LittleEndian.PutUint64(buf[16:24], t.New)
+	binary.LittleEndian.PutUint64(buf[24:32], t.Changed)
+	binary.LittleEndian.PutUint64(buf[32:40], t.Deleted)
+	copy(buf[40:], t.Hash[:])
+	return buf
+}
+
+func (t *Trailer) Deserialize(buf []byte) error {
+	if len(buf) != trailerLen {
+		return fmt.Errorf("invalid length: got:%d want:%d",
+			len(buf), trailerLen)
+	}
+	t.Records = binary.LittleEndian.Uint64(buf[0:8])
+	t.DataBytes = binary.LittleEndian.Uint64(buf[8:16])
+	t.New = binary.LittleEndian.Uint64(buf[16:24])
+	t.Changed = binary.LittleEndian.Uint64(buf[24:32])
+	t.Deleted = binary.LittleEndian.Uint64(buf[32:40])
+	copy(t.Hash[:], buf[40:])
+	return nil
+}
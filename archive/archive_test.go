@@ -0,0 +1,383 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jrick/ss/keyfile"
+	"github.com/jrick/ss/stream"
+)
+
+// testRecord is a record written to a test snapshot.
+type testRecord struct {
+	kind Kind
+	md   Metadata
+	data []byte
+}
+
+func testKeys(t *testing.T) (*stream.PublicKey, *stream.SecretKey) {
+	t.Helper()
+	pk, sk := new(bytes.Buffer), new(bytes.Buffer)
+	params := &keyfile.Argon2idParams{Time: 1, Memory: 64}
+	if _, err := keyfile.GenerateKeys(rand.Reader, pk, sk, []byte("test"), params, ""); err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := keyfile.ReadPublicKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretKey, _, err := keyfile.OpenSecretKey(sk, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pubKey, secretKey
+}
+
+func testHeader(version uint16) Header {
+	hdr := Header{
+		Version:   version,
+		Hostname:  "host",
+		Timestamp: time.Unix(1700000000, 0),
+		Increment: 3,
+	}
+	if version >= Version4 {
+		hdr.Created = time.Unix(1700003600, 0)
+	}
+	return hdr
+}
+
+// testRecords returns records using the features of version.
+func testRecords(version uint16) []testRecord {
+	recs := []testRecord{{
+		kind: KindEntry,
+		md: Metadata{
+			Path:    "/dir",
+			Attribs: FileAttributes{MTim: 1, Mode: uint32(os.ModeDir | 0o755), UID: 1, GID: 2},
+		},
+	}, {
+		kind: KindEntry,
+		md: Metadata{
+			Path:    "/dir/file",
+			Attribs: FileAttributes{Size: 5, MTim: 2, Mode: 0o644},
+		},
+		data: []byte("hello"),
+	}, {
+		kind: KindEntry,
+		md: Metadata{
+			Path:    "/dir/empty",
+			Attribs: FileAttributes{MTim: 3, Mode: 0o600},
+		},
+	}}
+	if version >= Version2 {
+		link := testRecord{
+			kind: KindEntry,
+			md: Metadata{
+				Path:    "/dir/link",
+				Attribs: FileAttributes{Size: 5, MTim: 2, Mode: 0o644},
+			},
+		}
+		link.md.SetLink("/dir/file")
+		recs = append(recs, link, testRecord{
+			kind: KindChange,
+			md: Metadata{
+				Path:    "/dir/changed",
+				Attribs: FileAttributes{Size: 3, MTim: 4, Mode: 0o644},
+			},
+			data: []byte("delta"),
+		})
+	}
+	// Version 1 deletions carry empty attributes.
+	return append(recs, testRecord{
+		kind: KindDelete,
+		md:   Metadata{Path: "/deleted"},
+	})
+}
+
+// writeSnapshot writes recs as a snapshot of version to a new file, whose
+// path is returned.
+func writeSnapshot(t *testing.T, pubKey *stream.PublicKey, version uint16, recs []testRecord) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "snapshot")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if version < Version3 {
+		err = writeStream(f, pubKey, version, recs, nil)
+	} else {
+		err = writeBlocks(f, pubKey, version, recs)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// writeBlocks writes a snapshot with Writer, as version 3 when asked to.
+func writeBlocks(w io.Writer, pubKey *stream.PublicKey, version uint16, recs []testRecord) error {
+	var aw *Writer
+	var err error
+	if version == Version {
+		aw, err = Create(w, pubKey, gzip.BestSpeed, testHeader(version))
+	} else {
+		// Older block versions only differ by their header.
+		aw, err = createVersion(w, pubKey, testHeader(version))
+	}
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		if rec.kind == KindDelete {
+			err = aw.Delete(rec.md.Path)
+		} else {
+			_, err = aw.Add(rec.kind, &rec.md, bytes.NewReader(rec.data),
+				int64(len(rec.data)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+func createVersion(w io.Writer, pubKey *stream.PublicKey, hdr Header) (*Writer, error) {
+	bw, err := newBlockWriter(w, pubKey, gzip.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	aw := &Writer{
+		w:    io.MultiWriter(bw, h),
+		bw:   bw,
+		hash: h,
+		buf:  new(bytes.Buffer),
+	}
+	if err = hdr.Serialize(aw.buf); err != nil {
+		return nil, err
+	}
+	return aw, aw.flush()
+}
+
+// writeStream writes a version 1 or 2 snapshot, a single encrypted gzip
+// stream.  tamper, when not nil, modifies the trailer before it is written.
+func writeStream(w io.Writer, pubKey *stream.PublicKey, version uint16, recs []testRecord, tamper func(*Trailer)) error {
+	plain := new(bytes.Buffer)
+	hdr := testHeader(version)
+	if err := hdr.Serialize(plain); err != nil {
+		return err
+	}
+	var trailer Trailer
+	var u64 [8]byte
+	for _, rec := range recs {
+		if version >= Version2 {
+			plain.WriteByte(byte(rec.kind))
+			if err := rec.md.Serialize(plain); err != nil {
+				return err
+			}
+		} else {
+			var pathLen [2]byte
+			binary.LittleEndian.PutUint16(pathLen[:], uint16(len(rec.md.Path)))
+			plain.Write(pathLen[:])
+			plain.WriteString(rec.md.Path)
+			if err := rec.md.Attribs.Serialize(plain); err != nil {
+				return err
+			}
+		}
+		binary.LittleEndian.PutUint64(u64[:], uint64(len(rec.data)))
+		plain.Write(u64[:])
+		plain.Write(rec.data)
+		trailer.count(rec.kind, int64(len(rec.data)))
+	}
+	if version >= Version2 {
+		plain.WriteByte(byte(KindTrailer))
+		trailer.Hash = sha256.Sum256(plain.Bytes())
+		if tamper != nil {
+			tamper(&trailer)
+		}
+		plain.Write(trailer.Serialize())
+	}
+
+	zbuf := new(bytes.Buffer)
+	gz := gzip.NewWriter(zbuf)
+	if _, err := gz.Write(plain.Bytes()); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	header, key, err := stream.Encapsulate(rand.Reader, pubKey)
+	if err != nil {
+		return err
+	}
+	return stream.Encrypt(w, zbuf, header, key)
+}
+
+// readSnapshot reads every record of file along with its data.
+func readSnapshot(file string, secretKey *stream.SecretKey) (*Header, []testRecord, *Trailer, error) {
+	r, err := Open(file, secretKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var recs []testRecord
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			r.Close()
+			return nil, nil, nil, err
+		}
+		data, err := io.ReadAll(rec.Data)
+		if err != nil {
+			r.Close()
+			return nil, nil, nil, err
+		}
+		recs = append(recs, testRecord{kind: rec.Kind, md: rec.Metadata, data: data})
+	}
+	if err = r.Close(); err != nil {
+		return nil, nil, nil, err
+	}
+	return &r.Header, recs, r.Trailer(), nil
+}
+
+func checkRecord(t *testing.T, got, want testRecord) {
+	t.Helper()
+	if got.kind != want.kind || got.md.Path != want.md.Path ||
+		got.md.Attribs != want.md.Attribs || !bytes.Equal(got.data, want.data) {
+		t.Errorf("record %v %q %+v %q, want %v %q %+v %q", got.kind,
+			got.md.Path, got.md.Attribs, got.data, want.kind,
+			want.md.Path, want.md.Attribs, want.data)
+	}
+	gotLink, _ := got.md.Link()
+	wantLink, _ := want.md.Link()
+	if gotLink != wantLink {
+		t.Errorf("%q: link %q, want %q", got.md.Path, gotLink, wantLink)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	pubKey, secretKey := testKeys(t)
+	for _, version := range []uint16{Version1, Version2, Version3, Version4} {
+		recs := testRecords(version)
+		file := writeSnapshot(t, pubKey, version, recs)
+		hdr, got, trailer, err := readSnapshot(file, secretKey)
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		want := testHeader(version)
+		if hdr.Version != want.Version || hdr.Hostname != want.Hostname ||
+			!hdr.Timestamp.Equal(want.Timestamp) ||
+			hdr.Increment != want.Increment || !hdr.Created.Equal(want.Created) {
+			t.Errorf("version %d: header %+v, want %+v", version, hdr, want)
+		}
+		if len(got) != len(recs) {
+			t.Fatalf("version %d: %d records, want %d", version, len(got),
+				len(recs))
+		}
+		for i := range recs {
+			checkRecord(t, got[i], recs[i])
+		}
+
+		switch {
+		case version == Version1 && trailer != nil:
+			t.Errorf("version 1 trailer %+v", trailer)
+		case version >= Version2 && trailer == nil:
+			t.Errorf("version %d: no trailer", version)
+		case version >= Version2 && trailer.Records != uint64(len(recs)):
+			t.Errorf("version %d: trailer of %d records, want %d", version,
+				trailer.Records, len(recs))
+		}
+
+		r, err := Open(file, secretKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, err := r.Index()
+		r.Close()
+		switch {
+		case err != nil:
+			t.Errorf("version %d: index: %v", version, err)
+		case version < Version3 && index != nil:
+			t.Errorf("version %d: unexpected index", version)
+		case version >= Version3 && len(index) != len(recs):
+			t.Errorf("version %d: %d index entries, want %d", version,
+				len(index), len(recs))
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	pubKey, secretKey := testKeys(t)
+	recs := testRecords(Version)
+	hdr, trailer, err := Verify(writeSnapshot(t, pubKey, Version, recs), secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Version != Version || trailer == nil || trailer.Records != uint64(len(recs)) ||
+		trailer.New != 4 || trailer.Changed != 1 || trailer.Deleted != 1 ||
+		trailer.DataBytes != 10 {
+		t.Errorf("verified %+v %+v", hdr, trailer)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	pubKey, secretKey := testKeys(t)
+	for _, version := range []uint16{Version1, Version2, Version3, Version4} {
+		file := writeSnapshot(t, pubKey, version, testRecords(version))
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cuts := map[string]int{
+			"last byte": len(b) - 1,
+			"half":      len(b) / 2,
+		}
+		if version >= Version3 {
+			cuts["footer"] = len(b) - footerLen
+		}
+		for name, n := range cuts {
+			if err = os.WriteFile(file, b[:n], 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, _, _, err = readSnapshot(file, secretKey)
+			if err == nil {
+				t.Errorf("version %d: %s cut off: no error", version, name)
+				continue
+			}
+			// The stream of older versions authenticates its
+			// chunks, so a cut may also be reported as a failure
+			// to decrypt.
+			if version >= Version3 && !errors.Is(err, ErrTruncated) {
+				t.Errorf("version %d: %s cut off: %v", version, name, err)
+			}
+		}
+	}
+}
+
+func TestTrailerMismatch(t *testing.T) {
+	pubKey, secretKey := testKeys(t)
+	buf := new(bytes.Buffer)
+	err := writeStream(buf, pubKey, Version2, testRecords(Version2),
+		func(t *Trailer) { t.Records-- })
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "snapshot")
+	if err = os.WriteFile(file, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = readSnapshot(file, secretKey); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("trailer mismatch: %v", err)
+	}
+}
@@ -0,0 +1,452 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jrick/ss/stream"
+)
+
+// Version 3 snapshots split the record stream into blocks of blockSize
+// uncompressed bytes.  Each block is compressed and encrypted on its own so
+// that a reader can start at any block.  The file is laid out as:
+//
+//	magic | stream header | block... | index block |
+//	u64 index offset | u64 number of blocks | magic
+//
+// where each block is a u32 length followed by a stream encrypted with a key
+// derived from the stream header key and the block number.  The index block
+// holds the offset of every block and the offset of every record in the
+// uncompressed record stream.
+
+var blockMagic = []byte("MULTUS\x00\x03")
+
+const (
+	blockSize    = 1024 * 1024
+	maxBlockLen  = 2 * blockSize
+	footerLen    = 8 + 8 + 8
+	maxIndexSize = 1 << 30
+)
+
+// IndexEntry locates a record in the uncompressed record stream.
+type IndexEntry struct {
+	Path   string
+	Offset int64
+}
+
+// blockKey derives the key of block n from the snapshot key.
+func blockKey(key *stream.SymmetricKey, n uint64) *stream.SymmetricKey {
+	var nb [8]byte
+	binary.LittleEndian.PutUint64(nb[:], n)
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("multus block"))
+	mac.Write(nb[:])
+	bk := new(stream.SymmetricKey)
+	copy(bk[:], mac.Sum(nil))
+	return bk
+}
+
+// blockHeader is the associated data of block n.  stream.Encrypt writes it
+// at the start of the block.
+func blockHeader(n uint64) []byte {
+	var nb [8]byte
+	binary.LittleEndian.PutUint64(nb[:], n)
+	return nb[:]
+}
+
+type blockWriter struct {
+	w       io.Writer
+	key     *stream.SymmetricKey
+	gz      *gzip.Writer
+	plain   *bytes.Buffer
+	zbuf    *bytes.Buffer
+	ebuf    *bytes.Buffer
+	offset  int64
+	offsets []int64
+	index   []IndexEntry
+}
+
+func newBlockWriter(w io.Writer, pubKey *stream.PublicKey, gzLevel int) (*blockWriter, error) {
+	header, key, err := stream.Encapsulate(rand.Reader, pubKey)
+	if err != nil {
+		return nil, err
+	}
+	zbuf := new(bytes.Buffer)
+	gz, err := gzip.NewWriterLevel(zbuf, gzLevel)
+	if err != nil {
+		return nil, err
+	}
+	bw := &blockWriter{
+		w:     w,
+		key:   key,
+		gz:    gz,
+		plain: new(bytes.Buffer),
+		zbuf:  zbuf,
+		ebuf:  new(bytes.Buffer),
+	}
+	if err = bw.write(blockMagic); err != nil {
+		return nil, err
+	}
+	if err = bw.write(header); err != nil {
+		return nil, err
+	}
+	return bw, nil
+}
+
+func (bw *blockWriter) write(b []byte) error {
+	numBytes, err := bw.w.Write(b)
+	bw.offset += int64(numBytes)
+	return err
+}
+
+// Write buffers uncompressed record data and writes out every full block.
+func (bw *blockWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := blockSize - bw.plain.Len()
+		if n > len(p) {
+			n = len(p)
+		}
+		bw.plain.Write(p[:n])
+		written += n
+		p = p[n:]
+		if bw.plain.Len() == blockSize {
+			if err := bw.flushBlock(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (bw *blockWriter) seal(n uint64, plain []byte) error {
+	bw.zbuf.Reset()
+	bw.gz.Reset(bw.zbuf)
+	if _, err := bw.gz.Write(plain); err != nil {
+		return err
+	}
+	if err := bw.gz.Close(); err != nil {
+		return err
+	}
+
+	bw.ebuf.Reset()
+	bw.ebuf.Write([]byte{0, 0, 0, 0})
+	err := stream.Encrypt(bw.ebuf, bw.zbuf, blockHeader(n), blockKey(bw.key, n))
+	if err != nil {
+		return err
+	}
+	b := bw.ebuf.Bytes()
+	binary.LittleEndian.PutUint32(b[0:4], uint32(len(b)-4))
+	return bw.write(b)
+}
+
+func (bw *blockWriter) flushBlock() error {
+	bw.offsets = append(bw.offsets, bw.offset)
+	err := bw.seal(uint64(len(bw.offsets)-1), bw.plain.Bytes())
+	bw.plain.Reset()
+	return err
+}
+
+// Close writes the last block, the index and the footer.
+func (bw *blockWriter) Close() error {
+	if bw.plain.Len() > 0 {
+		if err := bw.flushBlock(); err != nil {
+			return err
+		}
+	}
+
+	indexOffset := bw.offset
+	if err := bw.seal(uint64(len(bw.offsets)), bw.serializeIndex()); err != nil {
+		return err
+	}
+
+	footer := make([]byte, footerLen)
+	binary.LittleEndian.PutUint64(footer[0:8], uint64(indexOffset))
+	binary.LittleEndian.PutUint64(footer[8:16], uint64(len(bw.offsets)))
+	copy(footer[16:], blockMagic)
+	return bw.write(footer)
+}
+
+func (bw *blockWriter) serializeIndex() []byte {
+	b := new(bytes.Buffer)
+	var u64 [8]byte
+	putU64 := func(v uint64) {
+		binary.LittleEndian.PutUint64(u64[:], v)
+		b.Write(u64[:])
+	}
+	putU64(blockSize)
+	putU64(uint64(len(bw.offsets)))
+	for _, offset := range bw.offsets {
+		putU64(uint64(offset))
+	}
+	putU64(uint64(len(bw.index)))
+	for _, e := range bw.index {
+		var pathLen [2]byte
+		binary.LittleEndian.PutUint16(pathLen[:], uint16(len(e.Path)))
+		b.Write(pathLen[:])
+		b.WriteString(e.Path)
+		putU64(uint64(e.Offset))
+	}
+	return b.Bytes()
+}
+
+type blockReader struct {
+	r            io.ReaderAt
+	key          *stream.SymmetricKey
+	indexOffset  int64
+	footerOffset int64
+	numBlocks    uint64
+	blockSize    int64
+	offsets      []int64
+	index        []IndexEntry
+
+	n      uint64 // number of the next block
+	next   int64  // file offset of the next block
+	loaded bool   // plain holds block n-1
+	block  *bytes.Reader
+	ebuf   []byte
+	plain  *bytes.Buffer
+	zbuf   *bytes.Buffer
+	gz     *gzip.Reader
+}
+
+// isBlockFile reports whether r starts with the version 3 magic.
+func isBlockFile(r io.ReaderAt) (bool, error) {
+	magic := make([]byte, len(blockMagic))
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(magic, blockMagic), nil
+}
+
+func newBlockReader(r io.ReaderAt, size int64, secretKey *stream.SecretKey) (*blockReader, error) {
+	header, err := stream.ReadHeader(io.NewSectionReader(r, int64(len(blockMagic)), size))
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	key, err := stream.Decapsulate(header, secretKey)
+	if err != nil {
+		return nil, err
+	}
+	first := int64(len(blockMagic) + len(header.Bytes))
+
+	// A missing footer means the snapshot was not completely written.
+	if size < first+footerLen {
+		return nil, ErrTruncated
+	}
+	footer := make([]byte, footerLen)
+	if _, err = r.ReadAt(footer, size-footerLen); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[16:], blockMagic) {
+		return nil, ErrTruncated
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	if indexOffset < first || indexOffset > size-footerLen {
+		return nil, fmt.Errorf("%w: invalid index offset %d", ErrCorrupt,
+			indexOffset)
+	}
+
+	return &blockReader{
+		r:            r,
+		key:          key,
+		indexOffset:  indexOffset,
+		footerOffset: size - footerLen,
+		numBlocks:    binary.LittleEndian.Uint64(footer[8:16]),
+		n:            0,
+		next:         first,
+		block:        bytes.NewReader(nil),
+		plain:        new(bytes.Buffer),
+		zbuf:         new(bytes.Buffer),
+	}, nil
+}
+
+// readBlock decrypts and decompresses block n found at offset into dst.  The
+// offset of the following block is returned.
+func (br *blockReader) readBlock(dst *bytes.Buffer, n uint64, offset int64) (int64, error) {
+	maxLen := int64(maxBlockLen)
+	if n == br.numBlocks {
+		maxLen = maxIndexSize
+	}
+
+	var lenBytes [4]byte
+	if _, err := br.r.ReadAt(lenBytes[:], offset); err != nil {
+		return 0, unexpected(err)
+	}
+	l := int64(binary.LittleEndian.Uint32(lenBytes[:]))
+	if l > maxLen {
+		return 0, fmt.Errorf("%w: block %d too long: %d", ErrCorrupt, n, l)
+	}
+	next := offset + 4 + l
+	if n < br.numBlocks && next > br.indexOffset {
+		return 0, fmt.Errorf("%w: block %d overlaps the index", ErrCorrupt, n)
+	}
+	if int64(cap(br.ebuf)) < l {
+		br.ebuf = make([]byte, l)
+	}
+	ebuf := br.ebuf[:l]
+	if _, err := br.r.ReadAt(ebuf, offset+4); err != nil {
+		return 0, unexpected(err)
+	}
+	hdr := blockHeader(n)
+	if len(ebuf) < len(hdr) || !bytes.Equal(ebuf[:len(hdr)], hdr) {
+		return 0, fmt.Errorf("%w: block %d out of sequence", ErrCorrupt, n)
+	}
+
+	br.zbuf.Reset()
+	// Blocks are read whole, so failing to decrypt or decompress one
+	// means it was modified.
+	err := stream.Decrypt(br.zbuf, bytes.NewReader(ebuf[len(hdr):]), hdr, blockKey(br.key, n))
+	if err != nil {
+		return 0, fmt.Errorf("%w: block %d: %v", ErrCorrupt, n, err)
+	}
+	if br.gz == nil {
+		br.gz, err = gzip.NewReader(br.zbuf)
+	} else {
+		err = br.gz.Reset(br.zbuf)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%w: block %d: %v", ErrCorrupt, n, err)
+	}
+	dst.Reset()
+	if _, err = io.Copy(dst, io.LimitReader(br.gz, maxLen)); err != nil {
+		return 0, fmt.Errorf("%w: block %d: %v", ErrCorrupt, n, err)
+	}
+	return next, nil
+}
+
+// Read reads the uncompressed record stream sequentially.
+func (br *blockReader) Read(p []byte) (int, error) {
+	for br.block.Len() == 0 {
+		if br.n == br.numBlocks {
+			if br.next != br.indexOffset {
+				return 0, fmt.Errorf("%w: index offset mismatch", ErrCorrupt)
+			}
+			return 0, io.EOF
+		}
+		br.loaded = false
+		next, err := br.readBlock(br.plain, br.n, br.next)
+		if err != nil {
+			return 0, err
+		}
+		br.block.Reset(br.plain.Bytes())
+		br.n++
+		br.next = next
+		br.loaded = true
+	}
+	return br.block.Read(p)
+}
+
+// seek positions the reader at offset of the uncompressed record stream.
+// The block holding offset is only decoded when it is not the one loaded.
+func (br *blockReader) seek(offset int64) error {
+	if err := br.readIndex(); err != nil {
+		return err
+	}
+	n := uint64(offset / br.blockSize)
+	if offset < 0 || n >= br.numBlocks {
+		return fmt.Errorf("%w: invalid record offset %d", ErrCorrupt, offset)
+	}
+	if !br.loaded || br.n != n+1 {
+		br.loaded = false
+		next, err := br.readBlock(br.plain, n, br.offsets[n])
+		if err != nil {
+			return err
+		}
+		br.n = n + 1
+		br.next = next
+		br.loaded = true
+	}
+	off := offset % br.blockSize
+	if off >= int64(br.plain.Len()) {
+		return fmt.Errorf("%w: invalid record offset %d", ErrCorrupt, offset)
+	}
+	br.block.Reset(br.plain.Bytes())
+	br.block.Seek(off, io.SeekStart)
+	return nil
+}
+
+// readIndex loads the block offsets and the record index.
+func (br *blockReader) readIndex() error {
+	if br.offsets != nil {
+		return nil
+	}
+	b := new(bytes.Buffer)
+	next, err := br.readBlock(b, br.numBlocks, br.indexOffset)
+	if err != nil {
+		return err
+	}
+	if next != br.footerOffset {
+		return fmt.Errorf("%w: index length mismatch", ErrCorrupt)
+	}
+	return br.parseIndex(b.Bytes())
+}
+
+func (br *blockReader) parseIndex(buf []byte) error {
+	invalid := fmt.Errorf("%w: invalid index", ErrCorrupt)
+	u64 := func() (uint64, bool) {
+		if len(buf) < 8 {
+			return 0, false
+		}
+		v := binary.LittleEndian.Uint64(buf[0:8])
+		buf = buf[8:]
+		return v, true
+	}
+
+	size, ok := u64()
+	if !ok || size == 0 || size > maxBlockLen {
+		return invalid
+	}
+	numBlocks, ok := u64()
+	if !ok || numBlocks != br.numBlocks || numBlocks > uint64(len(buf)/8) {
+		return invalid
+	}
+	offsets := make([]int64, numBlocks)
+	for i := range offsets {
+		offset, _ := u64()
+		if offset >= uint64(br.indexOffset) ||
+			(i > 0 && int64(offset) <= offsets[i-1]) {
+			return invalid
+		}
+		offsets[i] = int64(offset)
+	}
+	numEntries, ok := u64()
+	if !ok || numEntries > uint64(len(buf)/(2+8)) {
+		return invalid
+	}
+	index := make([]IndexEntry, 0, numEntries)
+	for i := uint64(0); i < numEntries; i++ {
+		if len(buf) < 2 {
+			return invalid
+		}
+		pathLen := int(binary.LittleEndian.Uint16(buf[0:2]))
+		if len(buf) < 2+pathLen+8 {
+			return invalid
+		}
+		path := string(buf[2 : 2+pathLen])
+		buf = buf[2+pathLen:]
+		offset, _ := u64()
+		index = append(index, IndexEntry{
+			Path:   path,
+			Offset: int64(offset),
+		})
+	}
+	if len(buf) != 0 {
+		return invalid
+	}
+
+	br.blockSize = int64(size)
+	br.offsets = offsets
+	br.index = index
+	return nil
+}
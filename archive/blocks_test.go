@@ -0,0 +1,189 @@
+package archive
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/jrick/ss/stream"
+)
+
+// blockRecords returns records whose data spans several blocks.
+func blockRecords(t *testing.T) []testRecord {
+	t.Helper()
+	var recs []testRecord
+	for i := 0; i < 40; i++ {
+		data := make([]byte, 100*1024+i)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, testRecord{
+			kind: KindEntry,
+			md: Metadata{
+				Path:    fmt.Sprintf("/file%d", i),
+				Attribs: FileAttributes{Size: int64(len(data)), Mode: 0o644},
+			},
+			data: data,
+		})
+	}
+	return recs
+}
+
+// blockOffsets returns the file offsets of the blocks of file and of its
+// index.
+func blockOffsets(t *testing.T, file string, secretKey *stream.SecretKey) ([]int64, int64) {
+	t.Helper()
+	r, err := Open(file, secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err = r.br.readIndex(); err != nil {
+		t.Fatal(err)
+	}
+	return r.br.offsets, r.br.indexOffset
+}
+
+func TestSeek(t *testing.T) {
+	pubKey, secretKey := testKeys(t)
+	recs := blockRecords(t)
+	file := writeSnapshot(t, pubKey, Version, recs)
+	if offsets, _ := blockOffsets(t, file, secretKey); len(offsets) < 3 {
+		t.Fatalf("%d blocks", len(offsets))
+	}
+
+	r, err := Open(file, secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	index, err := r.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != len(recs) {
+		t.Fatalf("%d index entries, want %d", len(index), len(recs))
+	}
+	read := func(i int) {
+		t.Helper()
+		rec, err := r.Next()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		data, err := io.ReadAll(rec.Data)
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		checkRecord(t, testRecord{kind: rec.Kind, md: rec.Metadata, data: data}, recs[i])
+	}
+
+	// Forwards, backwards and then every other entry, leaving the data of
+	// the record sought unread.
+	for i := range index {
+		if err = r.Seek(index[i]); err != nil {
+			t.Fatal(err)
+		}
+		read(i)
+	}
+	for i := len(index) - 1; i >= 0; i-- {
+		if err = r.Seek(index[i]); err != nil {
+			t.Fatal(err)
+		}
+		read(i)
+	}
+	for i := 0; i < len(index); i += 2 {
+		if err = r.Seek(index[i]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = r.Next(); err != nil {
+			t.Fatal(err)
+		}
+		if i+1 < len(index) {
+			read(i + 1)
+		}
+	}
+
+	// The records following the last one sought are read sequentially.
+	if err = r.Seek(index[len(index)-3]); err != nil {
+		t.Fatal(err)
+	}
+	for i := len(index) - 3; i < len(index); i++ {
+		read(i)
+	}
+	if _, err = r.Next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("after the last record: %v", err)
+	}
+
+	if err = r.Seek(IndexEntry{Offset: -1}); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("invalid offset: %v", err)
+	}
+}
+
+func TestCorruptBlock(t *testing.T) {
+	pubKey, secretKey := testKeys(t)
+	recs := blockRecords(t)
+	file := writeSnapshot(t, pubKey, Version, recs)
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets, indexOffset := blockOffsets(t, file, secretKey)
+
+	corrupt := func(offset int64) {
+		t.Helper()
+		c := append([]byte(nil), b...)
+		c[offset] ^= 1
+		if err := os.WriteFile(file, c, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name   string
+		offset int64
+	}{
+		{"data", offsets[1] + 100},
+		{"length", offsets[1] + 3},
+		{"block number", offsets[1] + 4},
+		{"last block", indexOffset - 1},
+	}
+	for _, tt := range tests {
+		corrupt(tt.offset)
+		if _, _, _, err = readSnapshot(file, secretKey); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: read: %v", tt.name, err)
+		}
+	}
+
+	// Seeking decodes the block of the entry.
+	corrupt(offsets[1] + 100)
+	r, err := Open(file, secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := r.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e IndexEntry
+	for _, e = range index {
+		if e.Offset >= blockSize && e.Offset < 2*blockSize {
+			break
+		}
+	}
+	if err = r.Seek(e); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("seek into a corrupt block: %v", err)
+	}
+	r.Close()
+
+	corrupt(indexOffset + 100)
+	r, err = Open(file, secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Index(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("corrupt index: %v", err)
+	}
+	r.Close()
+}
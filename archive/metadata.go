@@ -0,0 +1,277 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/smtc/rsync"
+)
+
+type FileAttributes struct {
+	Size int64
+	MTim int64
+	RDev uint64
+	Mode uint32
+	UID  uint32
+	GID  uint32
+}
+
+func (f FileAttributes) IsEmpty() bool {
+	return f.Size == 0 && f.MTim == 0 && f.RDev == 0 &&
+		f.Mode == 0 && f.UID == 0 && f.GID == 0
+}
+
+func (f *FileAttributes) Deserialize(buf []byte) error {
+	if len(buf) != 36 {
+		return fmt.Errorf("invalid length: got:%d want:%d",
+			len(buf), 36)
+	}
+	f.Size = int64(binary.LittleEndian.Uint64(buf[0:8]))
+	f.MTim = int64(binary.LittleEndian.Uint64(buf[8:16]))
+	f.RDev = binary.LittleEndian.Uint64(buf[16:24])
+	f.Mode = binary.LittleEndian.Uint32(buf[24:28])
+	f.UID = binary.LittleEndian.Uint32(buf[28:32])
+	f.GID = binary.LittleEndian.Uint32(buf[32:36])
+
+	return nil
+}
+
+func (f FileAttributes) Serialize(dstBuf *bytes.Buffer) error {
+	var buf [36]byte
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(f.Size))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(f.MTim))
+	binary.LittleEndian.PutUint64(buf[16:24], f.RDev)
+	binary.LittleEndian.PutUint32(buf[24:28], f.Mode)
+	binary.LittleEndian.PutUint32(buf[28:32], f.UID)
+	binary.LittleEndian.PutUint32(buf[32:36], f.GID)
+
+	_, err := dstBuf.Write(buf[:])
+	return err
+}
+
+var (
+	fSig = new(bytes.Buffer)
+)
+
+func (f FileAttributes) Signature(dstBuf *bytes.Buffer) error {
+	fSig.Reset()
+	if err := f.Serialize(fSig); err != nil {
+		return err
+	}
+
+	return rsync.GenSign(fSig, int64(fSig.Len()), 2048, dstBuf)
+}
+
+// FieldType identifies an optional Metadata field.  Readers skip fields they
+// do not know about.
+type FieldType uint16
+
+const (
+	// FieldXattrs holds the extended attributes of an entry, including
+	// the POSIX ACLs stored as system.posix_acl_access and
+	// system.posix_acl_default.  The value is a sequence of
+	// u16 name length | name | u32 value length | value sorted by name.
+	FieldXattrs FieldType = iota + 1
+
+	// FieldFlags holds the u32 inode flags of an entry, see chattr(1).
+	FieldFlags
+
+	// FieldLink marks a regular file as a hard link.  The value is the
+	// path of the entry it links to, which was recorded earlier in the
+	// same snapshot or in a previous increment.
+	FieldLink
+
+	// FieldSparse marks a regular file as sparse.  The value is a sorted
+	// sequence of u64 offset | u64 length data extents.  The record data
+	// of a new sparse file only holds the extents, while a delta is
+	// against the whole file.
+	FieldSparse
+)
+
+type Field struct {
+	Type  FieldType
+	Value []byte
+}
+
+type Metadata struct {
+	Path    string
+	Attribs FileAttributes
+	Fields  []Field
+}
+
+// Field returns the value of the first field of type t.
+func (m *Metadata) Field(t FieldType) ([]byte, bool) {
+	for _, f := range m.Fields {
+		if f.Type == t {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+// SetField replaces or adds a field of type t.
+func (m *Metadata) SetField(t FieldType, value []byte) {
+	for i := range m.Fields {
+		if m.Fields[i].Type == t {
+			m.Fields[i].Value = value
+			return
+		}
+	}
+	m.Fields = append(m.Fields, Field{Type: t, Value: value})
+}
+
+// Link returns the path of the entry m is a hard link to.
+func (m *Metadata) Link() (string, bool) {
+	target, ok := m.Field(FieldLink)
+	return string(target), ok
+}
+
+// SetLink records m as a hard link to target.
+func (m *Metadata) SetLink(target string) {
+	m.SetField(FieldLink, []byte(target))
+}
+
+func (m *Metadata) DataLen() int64 {
+	return m.Attribs.Size
+}
+
+// Serialize writes the path, attributes and fields using the current format
+// version.
+func (m *Metadata) Serialize(dstBuf *bytes.Buffer) error {
+	var offset int
+	pathLen := len(m.Path)
+	if pathLen > maxPathLen {
+		return fmt.Errorf("path too long: %d", pathLen)
+	}
+	buf := make([]byte, 2+pathLen)
+
+	binary.LittleEndian.PutUint16(buf[offset:offset+2], uint16(pathLen))
+	offset += 2
+	copy(buf[offset:offset+pathLen], m.Path)
+
+	if _, err := dstBuf.Write(buf); err != nil {
+		return err
+	}
+	if err := m.Attribs.Serialize(dstBuf); err != nil {
+		return err
+	}
+
+	fieldsLen := 0
+	for _, f := range m.Fields {
+		fieldsLen += 2 + 4 + len(f.Value)
+	}
+	if fieldsLen > maxFieldsLen {
+		return fmt.Errorf("%q: fields too long: %d", m.Path, fieldsLen)
+	}
+	var fl [4]byte
+	binary.LittleEndian.PutUint32(fl[:], uint32(fieldsLen))
+	if _, err := dstBuf.Write(fl[:]); err != nil {
+		return err
+	}
+	return m.serializeFields(dstBuf)
+}
+
+func (m *Metadata) serializeFields(dstBuf *bytes.Buffer) error {
+	for _, f := range m.Fields {
+		var tl [6]byte
+		binary.LittleEndian.PutUint16(tl[0:2], uint16(f.Type))
+		binary.LittleEndian.PutUint32(tl[2:6], uint32(len(f.Value)))
+		if _, err := dstBuf.Write(tl[:]); err != nil {
+			return err
+		}
+		if _, err := dstBuf.Write(f.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deserializeFields(buf []byte) ([]Field, error) {
+	var fields []Field
+	for len(buf) > 0 {
+		if len(buf) < 6 {
+			return nil, fmt.Errorf("invalid field: short header")
+		}
+		t := FieldType(binary.LittleEndian.Uint16(buf[0:2]))
+		l := binary.LittleEndian.Uint32(buf[2:6])
+		buf = buf[6:]
+		if uint64(l) > uint64(len(buf)) {
+			return nil, fmt.Errorf("invalid field %d: length %d exceeds %d",
+				t, l, len(buf))
+		}
+		value := make([]byte, l)
+		copy(value, buf[:l])
+		fields = append(fields, Field{Type: t, Value: value})
+		buf = buf[l:]
+	}
+	return fields, nil
+}
+
+// Signature covers the attributes and, when present, the fields.  Entries
+// without fields keep the signature older versions generated for them.
+func (m *Metadata) Signature(dstBuf *bytes.Buffer) error {
+	if len(m.Fields) == 0 {
+		return m.Attribs.Signature(dstBuf)
+	}
+	fSig.Reset()
+	if err := m.Attribs.Serialize(fSig); err != nil {
+		return err
+	}
+	if err := m.serializeFields(fSig); err != nil {
+		return err
+	}
+
+	return rsync.GenSign(fSig, int64(fSig.Len()), 2048, dstBuf)
+}
+
+func NewMetadata(filepath string) (*Metadata, error) {
+	stat, err := os.Lstat(filepath)
+	if err != nil {
+		return nil, err
+	}
+	statT, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, fmt.Errorf("stat returned type %T", statT)
+	}
+
+	fileAttributes := FileAttributes{
+		Size: stat.Size(),
+		MTim: stat.ModTime().UnixNano(),
+		Mode: uint32(stat.Mode()),
+		UID:  statT.Uid,
+		GID:  statT.Gid,
+		RDev: uint64(statT.Rdev),
+	}
+	MD := Metadata{
+		Attribs: fileAttributes,
+		Path:    filepath,
+	}
+
+	xattrs, err := readXattrs(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("%q: xattrs: %w", filepath, err)
+	}
+	if len(xattrs) > 0 {
+		if err = MD.SetXattrs(xattrs); err != nil {
+			return nil, err
+		}
+	}
+	extents, sparse, err := readExtents(filepath, stat.Mode(), statT)
+	if err != nil {
+		return nil, fmt.Errorf("%q: extents: %w", filepath, err)
+	}
+	if sparse {
+		MD.SetExtents(extents)
+	}
+	flags, err := readFlags(filepath, stat.Mode())
+	if err != nil {
+		return nil, fmt.Errorf("%q: flags: %w", filepath, err)
+	}
+	if flags != 0 {
+		MD.SetFlags(flags)
+	}
+	return &MD, nil
+}
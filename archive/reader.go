@@ -0,0 +1,412 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jrick/ss/stream"
+	"golang.org/x/sync/errgroup"
+)
+
+// Header is written at the start of every snapshot.  Timestamp identifies
+// the chain of increments while Created is when this increment was started.
+// Created is zero for snapshots older than Version4.
+type Header struct {
+	Version   uint16
+	Hostname  string
+	Timestamp time.Time
+	Increment uint16
+	Created   time.Time
+}
+
+func (h *Header) Serialize(dstBuf *bytes.Buffer) error {
+	hostLen := len(h.Hostname)
+	if hostLen > 255 {
+		return fmt.Errorf("hostname too long: %d", hostLen)
+	}
+	b := make([]byte, 2+1+hostLen+8+2, 2+1+hostLen+8+2+8)
+
+	offset := 0
+	binary.LittleEndian.PutUint16(b[offset:offset+2], h.Version)
+	offset += 2
+	b[offset] = byte(hostLen)
+	offset++
+	copy(b[offset:offset+hostLen], h.Hostname)
+	offset += hostLen
+	binary.LittleEndian.PutUint64(b[offset:offset+8], uint64(h.Timestamp.Unix()))
+	offset += 8
+	binary.LittleEndian.PutUint16(b[offset:offset+2], h.Increment)
+	if h.Version >= Version4 {
+		var created [8]byte
+		binary.LittleEndian.PutUint64(created[:], uint64(h.Created.Unix()))
+		b = append(b, created[:]...)
+	}
+
+	_, err := dstBuf.Write(b)
+	return err
+}
+
+// Record is a single entry of a snapshot.  Data is only valid until the
+// next call to Reader.Next.
+type Record struct {
+	Kind     Kind
+	Metadata Metadata
+	DataLen  int64
+	Data     io.Reader
+}
+
+// Reader decrypts and decodes a snapshot.
+type Reader struct {
+	Header Header
+
+	fd      *os.File
+	br      *blockReader
+	pipeR   *io.PipeReader
+	gz      *gzip.Reader
+	src     io.Reader
+	seeked  bool
+	hash    hash.Hash
+	eg      *errgroup.Group
+	data    *io.LimitedReader
+	buf     []byte
+	seen    Trailer
+	trailer *Trailer
+}
+
+// Open opens the snapshot file and reads its header.
+func Open(file string, secretKey *stream.SecretKey) (*Reader, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{
+		fd:   fd,
+		data: new(io.LimitedReader),
+		buf:  make([]byte, 255),
+		hash: sha256.New(),
+	}
+	blocks, err := isBlockFile(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if blocks {
+		err = r.openBlocks(secretKey)
+	} else {
+		err = r.openStream(secretKey)
+	}
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%q: %w", file, err)
+	}
+	if err = r.readHeader(); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%q: %w", file, err)
+	}
+	if blocks != (r.Header.Version >= Version3) {
+		r.Close()
+		return nil, fmt.Errorf("%q: %w: unexpected version %d", file,
+			ErrCorrupt, r.Header.Version)
+	}
+	return r, nil
+}
+
+// openBlocks reads version 3 and later snapshots.
+func (r *Reader) openBlocks(secretKey *stream.SecretKey) error {
+	st, err := r.fd.Stat()
+	if err != nil {
+		return err
+	}
+	r.br, err = newBlockReader(r.fd, st.Size(), secretKey)
+	if err != nil {
+		return err
+	}
+	r.src = io.TeeReader(r.br, r.hash)
+	return nil
+}
+
+// openStream reads snapshots written as a single encrypted gzip stream.
+func (r *Reader) openStream(secretKey *stream.SecretKey) error {
+	header, err := stream.ReadHeader(r.fd)
+	if err != nil {
+		return err
+	}
+	symKey, err := stream.Decapsulate(header, secretKey)
+	if err != nil {
+		return err
+	}
+
+	pipeR, pipeW := io.Pipe()
+	r.pipeR = pipeR
+	r.eg = new(errgroup.Group)
+	r.eg.Go(func() error {
+		err := stream.Decrypt(pipeW, r.fd, header.Bytes, symKey)
+		pipeW.CloseWithError(err)
+		return err
+	})
+	r.gz, err = gzip.NewReader(pipeR)
+	if err != nil {
+		return err
+	}
+	r.src = io.TeeReader(r.gz, r.hash)
+	return nil
+}
+
+// Index returns the location of every record.  It returns nil for snapshots
+// written before version 3.
+func (r *Reader) Index() ([]IndexEntry, error) {
+	if r.br == nil {
+		return nil, nil
+	}
+	if err := r.br.readIndex(); err != nil {
+		return nil, err
+	}
+	return r.br.index, nil
+}
+
+// Seek positions the reader so that the following call to Next returns the
+// record located by e.  The trailer hash cannot be verified once Seek has
+// been called.
+func (r *Reader) Seek(e IndexEntry) error {
+	if r.br == nil {
+		return fmt.Errorf("snapshot version %d has no index",
+			r.Header.Version)
+	}
+	if err := r.br.seek(e.Offset); err != nil {
+		return err
+	}
+	r.data.N = 0
+	r.seeked = true
+	return nil
+}
+
+func (r *Reader) read(n int) ([]byte, error) {
+	if cap(r.buf) < n {
+		r.buf = make([]byte, n)
+	}
+	_, err := io.ReadFull(r.src, r.buf[:n])
+	return r.buf[:n], err
+}
+
+func (r *Reader) readHeader() error {
+	buf, err := r.read(3)
+	if err != nil {
+		return err
+	}
+	r.Header.Version = binary.LittleEndian.Uint16(buf[0:2])
+	if err = checkVersion(r.Header.Version); err != nil {
+		return err
+	}
+	hostLen := int(buf[2])
+
+	buf, err = r.read(hostLen + 8 + 2)
+	if err != nil {
+		return unexpected(err)
+	}
+	r.Header.Hostname = string(buf[0:hostLen])
+	r.Header.Timestamp = time.Unix(int64(binary.LittleEndian.Uint64(buf[hostLen:hostLen+8])), 0)
+	r.Header.Increment = binary.LittleEndian.Uint16(buf[hostLen+8 : hostLen+8+2])
+	if r.Header.Version >= Version4 {
+		buf, err = r.read(8)
+		if err != nil {
+			return unexpected(err)
+		}
+		r.Header.Created = time.Unix(int64(binary.LittleEndian.Uint64(buf)), 0)
+	}
+	return nil
+}
+
+// Next returns the next record of the snapshot.  Any unread data of the
+// previous record is skipped.  io.EOF is returned once all records have been
+// read and, for version 2 snapshots, the trailer has been verified.
+func (r *Reader) Next() (*Record, error) {
+	if r.trailer != nil {
+		return nil, io.EOF
+	}
+	if r.data.N > 0 {
+		if _, err := io.Copy(io.Discard, r.data); err != nil {
+			return nil, unexpected(err)
+		}
+		if r.data.N > 0 {
+			return nil, ErrTruncated
+		}
+	}
+
+	rec := &Record{
+		Kind: KindEntry,
+		Data: r.data,
+	}
+	var err error
+	if r.Header.Version >= Version2 {
+		rec.Kind, err = r.readKind()
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		if rec.Kind == KindTrailer {
+			if err = r.readTrailer(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+	}
+	// Version 1 snapshots have no trailer, so a clean io.EOF on a record
+	// boundary is the end of the snapshot.
+	buf, err := r.read(2)
+	if err != nil {
+		if r.Header.Version >= Version2 || !errors.Is(err, io.EOF) {
+			err = unexpected(err)
+		}
+		return nil, err
+	}
+	pathLen := int(binary.LittleEndian.Uint16(buf[0:2]))
+
+	buf, err = r.read(pathLen + 36)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	rec.Metadata.Path = string(buf[0:pathLen])
+	if err = rec.Metadata.Attribs.Deserialize(buf[pathLen : pathLen+36]); err != nil {
+		return nil, err
+	}
+
+	if r.Header.Version >= Version2 {
+		buf, err = r.read(4)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		fieldsLen := binary.LittleEndian.Uint32(buf[0:4])
+		if fieldsLen > maxFieldsLen {
+			return nil, fmt.Errorf("%q: fields too long: %d",
+				rec.Metadata.Path, fieldsLen)
+		}
+		buf, err = r.read(int(fieldsLen))
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		rec.Metadata.Fields, err = deserializeFields(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", rec.Metadata.Path, err)
+		}
+	}
+
+	buf, err = r.read(8)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	rec.DataLen = int64(binary.LittleEndian.Uint64(buf[0:8]))
+	if r.Header.Version < Version2 && rec.Metadata.Attribs.IsEmpty() {
+		rec.Kind = KindDelete
+	}
+	r.seen.count(rec.Kind, rec.DataLen)
+
+	r.data.R = r.src
+	r.data.N = rec.DataLen
+	return rec, nil
+}
+
+func (r *Reader) readTrailer() error {
+	copy(r.seen.Hash[:], r.hash.Sum(nil))
+
+	buf, err := r.read(trailerLen)
+	if err != nil {
+		return unexpected(err)
+	}
+	var t Trailer
+	if err = t.Deserialize(buf); err != nil {
+		return err
+	}
+	if !r.seeked && t != r.seen {
+		return fmt.Errorf("%w: trailer mismatch: records %d/%d data bytes %d/%d",
+			ErrCorrupt, r.seen.Records, t.Records, r.seen.DataBytes, t.DataBytes)
+	}
+	if _, err = r.read(1); !errors.Is(err, io.EOF) {
+		if err == nil {
+			return fmt.Errorf("%w: data after trailer", ErrCorrupt)
+		}
+		return unexpected(err)
+	}
+	r.trailer = &t
+	return nil
+}
+
+// Trailer returns the verified trailer once Next has returned io.EOF.  It
+// returns nil for version 1 snapshots.
+func (r *Reader) Trailer() *Trailer {
+	return r.trailer
+}
+
+func (r *Reader) readKind() (Kind, error) {
+	buf, err := r.read(1)
+	if err != nil {
+		return 0, err
+	}
+	kind := Kind(buf[0])
+	switch kind {
+	case KindEntry, KindChange, KindDelete, KindTrailer:
+		return kind, nil
+	}
+	return 0, fmt.Errorf("unknown record kind %d", kind)
+}
+
+func unexpected(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrTruncated
+	}
+	return err
+}
+
+// Verify reads the whole snapshot and checks it against its trailer.  The
+// trailer is nil for version 1 snapshots, which can only be checked for
+// truncation inside a record.
+func Verify(file string, secretKey *stream.SecretKey) (*Header, *Trailer, error) {
+	r, err := Open(file, secretKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		_, err = r.Next()
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, io.EOF) {
+		r.Close()
+		return nil, nil, fmt.Errorf("%q: %w", file, err)
+	}
+	if err = r.Close(); err != nil {
+		return nil, nil, fmt.Errorf("%q: %w", file, err)
+	}
+	return &r.Header, r.trailer, nil
+}
+
+// Close releases all resources held by the reader.
+func (r *Reader) Close() error {
+	var gzErr, err error
+	if r.gz != nil {
+		gzErr = r.gz.Close()
+	}
+	if r.pipeR != nil {
+		r.pipeR.Close()
+		err = r.eg.Wait()
+		if errors.Is(err, io.ErrClosedPipe) {
+			// The reader was closed before the whole file was
+			// decrypted.
+			err = nil
+		}
+	}
+	if fdErr := r.fd.Close(); err == nil {
+		err = fdErr
+	}
+	if err == nil {
+		err = gzErr
+	}
+	return err
+}
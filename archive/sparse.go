@@ -0,0 +1,67 @@
+package archive
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Extent is a range of a sparse file holding data.  Everything outside the
+// extents of a file is a hole.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// Extents returns the data extents recorded for a sparse file.  The returned
+// bool is false when m is not sparse.
+func (m *Metadata) Extents() ([]Extent, bool, error) {
+	buf, ok := m.Field(FieldSparse)
+	if !ok {
+		return nil, false, nil
+	}
+	if len(buf)%16 != 0 {
+		return nil, false, fmt.Errorf("%q: invalid extents length: %d",
+			m.Path, len(buf))
+	}
+	extents := make([]Extent, 0, len(buf)/16)
+	var end int64
+	for ; len(buf) > 0; buf = buf[16:] {
+		e := Extent{
+			Offset: int64(binary.LittleEndian.Uint64(buf[0:8])),
+			Length: int64(binary.LittleEndian.Uint64(buf[8:16])),
+		}
+		if e.Offset < end || e.Length <= 0 ||
+			e.Offset+e.Length > m.Attribs.Size ||
+			e.Offset+e.Length < e.Offset {
+			return nil, false, fmt.Errorf("%q: invalid extent %d+%d",
+				m.Path, e.Offset, e.Length)
+		}
+		end = e.Offset + e.Length
+		extents = append(extents, e)
+	}
+	return extents, true, nil
+}
+
+// SetExtents marks m as a sparse file holding data in extents, which must be
+// sorted and not overlap.
+func (m *Metadata) SetExtents(extents []Extent) {
+	buf := make([]byte, 16*len(extents))
+	for i, e := range extents {
+		binary.LittleEndian.PutUint64(buf[i*16:], uint64(e.Offset))
+		binary.LittleEndian.PutUint64(buf[i*16+8:], uint64(e.Length))
+	}
+	m.SetField(FieldSparse, buf)
+}
+
+// ExtentsReader returns a reader of the data held in extents of r along with
+// its length.  It is the record data of a new sparse file.
+func ExtentsReader(r io.ReaderAt, extents []Extent) (io.Reader, int64) {
+	readers := make([]io.Reader, 0, len(extents))
+	var dataLen int64
+	for _, e := range extents {
+		readers = append(readers, io.NewSectionReader(r, e.Offset, e.Length))
+		dataLen += e.Length
+	}
+	return io.MultiReader(readers...), dataLen
+}
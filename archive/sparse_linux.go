@@ -0,0 +1,64 @@
+package archive
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// readExtents returns the data extents of path when it is a sparse regular
+// file.  A nil slice and false are returned otherwise.
+func readExtents(path string, mode os.FileMode, statT *syscall.Stat_t) ([]Extent, bool, error) {
+	if !mode.IsRegular() || statT.Blocks*512 >= statT.Size {
+		return nil, false, nil
+	}
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_NOFOLLOW|
+		unix.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, unix.EACCES) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	defer unix.Close(fd)
+
+	var extents []Extent
+	var offset int64
+	for offset < statT.Size {
+		data, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// No data past offset.
+			break
+		}
+		if errors.Is(err, unix.EINVAL) {
+			// SEEK_DATA is not supported.
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if data >= statT.Size {
+			break
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, false, err
+		}
+		if hole > statT.Size {
+			// The file grew.
+			hole = statT.Size
+		}
+		if hole <= data {
+			break
+		}
+		extents = append(extents, Extent{Offset: data, Length: hole - data})
+		offset = hole
+	}
+	if len(extents) == 1 && extents[0].Offset == 0 &&
+		extents[0].Length == statT.Size {
+		return nil, false, nil
+	}
+	return extents, true, nil
+}
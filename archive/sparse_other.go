@@ -0,0 +1,13 @@
+//go:build !linux
+
+package archive
+
+import (
+	"os"
+	"syscall"
+)
+
+// Sparse files are only detected on Linux.
+func readExtents(path string, mode os.FileMode, statT *syscall.Stat_t) ([]Extent, bool, error) {
+	return nil, false, nil
+}
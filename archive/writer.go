@@ -0,0 +1,129 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/jrick/ss/stream"
+)
+
+// Writer encodes a snapshot using the current format version.
+type Writer struct {
+	w            io.Writer
+	bw           *blockWriter
+	hash         hash.Hash
+	buf          *bytes.Buffer
+	trailer      Trailer
+	bytesWritten int64
+	closed       bool
+}
+
+// Create writes the snapshot header to w.  The snapshot is encrypted to
+// pubKey and compressed with gzLevel.  The header version is always set to
+// Version.
+func Create(w io.Writer, pubKey *stream.PublicKey, gzLevel int, hdr Header) (*Writer, error) {
+	bw, err := newBlockWriter(w, pubKey, gzLevel)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	aw := &Writer{
+		w:    io.MultiWriter(bw, h),
+		bw:   bw,
+		hash: h,
+		buf:  new(bytes.Buffer),
+	}
+	hdr.Version = Version
+	if err = hdr.Serialize(aw.buf); err != nil {
+		return nil, err
+	}
+	if err = aw.flush(); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+func (aw *Writer) flush() error {
+	numBytes, err := aw.w.Write(aw.buf.Bytes())
+	aw.bytesWritten += int64(numBytes)
+	aw.buf.Reset()
+	return err
+}
+
+func (aw *Writer) writeRecord(kind Kind, md *Metadata, dataLen int64) error {
+	if aw.closed {
+		return fmt.Errorf("archive writer closed")
+	}
+	aw.buf.WriteByte(byte(kind))
+	if err := md.Serialize(aw.buf); err != nil {
+		aw.buf.Reset()
+		return err
+	}
+	var dataLenBytes [8]byte
+	binary.LittleEndian.PutUint64(dataLenBytes[:], uint64(dataLen))
+	aw.buf.Write(dataLenBytes[:])
+	aw.trailer.count(kind, dataLen)
+	aw.bw.index = append(aw.bw.index, IndexEntry{
+		Path:   md.Path,
+		Offset: aw.bytesWritten,
+	})
+	return aw.flush()
+}
+
+// Add writes a KindEntry or KindChange record for md followed by dataLen
+// bytes read from dataReader.  The number of data bytes copied is returned.
+func (aw *Writer) Add(kind Kind, md *Metadata, dataReader io.Reader, dataLen int64) (int64, error) {
+	if kind != KindEntry && kind != KindChange {
+		return 0, fmt.Errorf("invalid record kind %v", kind)
+	}
+	if dataReader == nil {
+		dataLen = 0
+	}
+	if err := aw.writeRecord(kind, md, dataLen); err != nil {
+		return 0, err
+	}
+	if dataReader == nil {
+		return 0, nil
+	}
+	numBytes, err := io.CopyN(aw.w, dataReader, dataLen)
+	aw.bytesWritten += numBytes
+	return numBytes, err
+}
+
+// Delete writes a tombstone record for path.
+func (aw *Writer) Delete(path string) error {
+	return aw.writeRecord(KindDelete, &Metadata{Path: path}, 0)
+}
+
+// Close writes the trailer and the index.  It does not close the underlying
+// writer.
+func (aw *Writer) Close() error {
+	if aw.closed {
+		return nil
+	}
+	aw.buf.WriteByte(byte(KindTrailer))
+	if err := aw.flush(); err != nil {
+		return err
+	}
+	aw.closed = true
+	copy(aw.trailer.Hash[:], aw.hash.Sum(nil))
+	aw.buf.Write(aw.trailer.Serialize())
+	if err := aw.flush(); err != nil {
+		return err
+	}
+	return aw.bw.Close()
+}
+
+// Trailer returns the trailer summarizing the records written so far.
+func (aw *Writer) Trailer() Trailer {
+	return aw.trailer
+}
+
+// BytesWritten returns the number of uncompressed bytes written.
+func (aw *Writer) BytesWritten() int64 {
+	return aw.bytesWritten
+}
@@ -0,0 +1,92 @@
+package archive
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Xattr is a single extended attribute.
+type Xattr struct {
+	Name  string
+	Value []byte
+}
+
+// Xattrs returns the extended attributes recorded for m.
+func (m *Metadata) Xattrs() ([]Xattr, error) {
+	buf, ok := m.Field(FieldXattrs)
+	if !ok {
+		return nil, nil
+	}
+	var xattrs []Xattr
+	for len(buf) > 0 {
+		if len(buf) < 2 {
+			return nil, fmt.Errorf("%q: invalid xattr name length", m.Path)
+		}
+		nameLen := int(binary.LittleEndian.Uint16(buf[0:2]))
+		buf = buf[2:]
+		if len(buf) < nameLen+4 {
+			return nil, fmt.Errorf("%q: invalid xattr name", m.Path)
+		}
+		name := string(buf[:nameLen])
+		buf = buf[nameLen:]
+		valueLen := binary.LittleEndian.Uint32(buf[0:4])
+		buf = buf[4:]
+		if uint64(valueLen) > uint64(len(buf)) {
+			return nil, fmt.Errorf("%q: invalid xattr %q value", m.Path,
+				name)
+		}
+		value := make([]byte, valueLen)
+		copy(value, buf[:valueLen])
+		buf = buf[valueLen:]
+		xattrs = append(xattrs, Xattr{Name: name, Value: value})
+	}
+	return xattrs, nil
+}
+
+// SetXattrs records xattrs for m.  The attributes are sorted by name so the
+// signature does not depend on the order the file system returns them in.
+func (m *Metadata) SetXattrs(xattrs []Xattr) error {
+	sorted := make([]Xattr, len(xattrs))
+	copy(sorted, xattrs)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	var buf []byte
+	for _, x := range sorted {
+		if len(x.Name) > 1<<16-1 {
+			return fmt.Errorf("%q: xattr name too long: %d", m.Path,
+				len(x.Name))
+		}
+		var l [4]byte
+		binary.LittleEndian.PutUint16(l[0:2], uint16(len(x.Name)))
+		buf = append(buf, l[0:2]...)
+		buf = append(buf, x.Name...)
+		binary.LittleEndian.PutUint32(l[0:4], uint32(len(x.Value)))
+		buf = append(buf, l[0:4]...)
+		buf = append(buf, x.Value...)
+	}
+	m.SetField(FieldXattrs, buf)
+	return nil
+}
+
+// Flags returns the inode flags recorded for m.
+func (m *Metadata) Flags() (uint32, error) {
+	buf, ok := m.Field(FieldFlags)
+	if !ok {
+		return 0, nil
+	}
+	if len(buf) != 4 {
+		return 0, fmt.Errorf("%q: invalid flags length: %d", m.Path,
+			len(buf))
+	}
+	return binary.LittleEndian.Uint32(buf), nil
+}
+
+// SetFlags records the inode flags for m.
+func (m *Metadata) SetFlags(flags uint32) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], flags)
+	m.SetField(FieldFlags, buf[:])
+}
@@ -0,0 +1,122 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Inode flags from linux/fs.h.
+const (
+	fsSyncFL      = 0x00000008
+	fsImmutableFL = 0x00000010
+	fsAppendFL    = 0x00000020
+	fsNodumpFL    = 0x00000040
+	fsNoatimeFL   = 0x00000080
+	fsDirsyncFL   = 0x00010000
+	fsNocowFL     = 0x00800000
+)
+
+// FlagsMask is the set of inode flags recorded in snapshots.  Other flags
+// are either managed by the file system or cannot be set by chattr.
+const FlagsMask = fsSyncFL | fsImmutableFL | fsAppendFL | fsNodumpFL |
+	fsNoatimeFL | fsDirsyncFL | fsNocowFL
+
+// ignoreXattrErr reports whether err means the file system does not support
+// the requested attribute.
+func ignoreXattrErr(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.ENODATA) ||
+		errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EINVAL)
+}
+
+func readXattrs(path string) ([]Xattr, error) {
+	var names []byte
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			if ignoreXattrErr(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		names = make([]byte, size)
+		size, err = unix.Llistxattr(path, names)
+		if errors.Is(err, unix.ERANGE) {
+			// The list grew between calls.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = names[:size]
+		break
+	}
+
+	var xattrs []Xattr
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := readXattr(path, string(name))
+		if err != nil {
+			if ignoreXattrErr(err) {
+				continue
+			}
+			return nil, err
+		}
+		xattrs = append(xattrs, Xattr{Name: string(name), Value: value})
+	}
+	return xattrs, nil
+}
+
+func readXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if size == 0 {
+			return value, nil
+		}
+		size, err = unix.Lgetxattr(path, name, value)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	}
+}
+
+// readFlags returns the inode flags of regular files and directories.  The
+// flags of other file types cannot be read without following or opening
+// them.
+func readFlags(path string, mode os.FileMode) (uint32, error) {
+	if !mode.IsRegular() && !mode.IsDir() {
+		return 0, nil
+	}
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_NOFOLLOW|
+		unix.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, unix.EACCES) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer unix.Close(fd)
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		if ignoreXattrErr(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return flags & FlagsMask, nil
+}
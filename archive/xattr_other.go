@@ -0,0 +1,17 @@
+//go:build !linux
+
+package archive
+
+import "os"
+
+// FlagsMask is the set of inode flags recorded in snapshots.  Inode flags
+// are only recorded on Linux.
+const FlagsMask = 0
+
+func readXattrs(path string) ([]Xattr, error) {
+	return nil, nil
+}
+
+func readFlags(path string, mode os.FileMode) (uint32, error) {
+	return 0, nil
+}
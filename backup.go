@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/user"
@@ -11,16 +12,24 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jrick/ss/stream"
 	"github.com/smtc/rsync"
+	"multus/archive"
 )
 
 const (
 	memoryLimit = 1024 * 1024 * 10
 )
 
+// fileID identifies an inode.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
 func lookupGroup(groupName string) (int, error) {
 	group, err := user.LookupGroup(groupName)
 	if err != nil {
@@ -112,7 +121,7 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 
 	debugf("RUNNING LEVEL %d (%v)", sc.instance, sc.timeStamp)
 
-	snap, err := NewSnapshot(ctx, pubKey, uid, gid, cfg.Backup.GZLevel, destDir, sc.hostname, sc.timeStamp, sc.instance, sc.version)
+	snap, err := NewSnapshot(pubKey, uid, gid, cfg.Backup.GZLevel, destDir, sc.hostname, sc.timeStamp, sc.instance, time.Now())
 	if err != nil {
 		return err
 	}
@@ -125,6 +134,10 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 	startTime := time.Now()
 	filesExcluded := int32(0)
 
+	// links maps inodes with more than one name to the first name
+	// backed up.  Later names are recorded as hard links to it.
+	links := make(map[fileID]string)
+
 	var srcFD *os.File
 	for _, sourceDir := range cfg.Backup.Paths {
 		err = filepath.Walk(sourceDir, func(srcRelPath string, info os.FileInfo, err error) error {
@@ -167,7 +180,7 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 				}
 			}
 
-			MD, err := NewMetadata(srcPath)
+			MD, err := archive.NewMetadata(srcPath)
 			if err != nil {
 				return err
 			}
@@ -180,10 +193,24 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 
 			thisSig.Reset()
 			fileMode := os.FileMode(MD.Attribs.Mode)
+			if st, ok := info.Sys().(*syscall.Stat_t); ok &&
+				fileMode.IsRegular() && st.Nlink > 1 {
+				id := fileID{dev: uint64(st.Dev), ino: st.Ino}
+				if target, ok := links[id]; ok {
+					debugf("%q: hard link to %q", srcPath, target)
+					MD.SetLink(target)
+				} else {
+					links[id] = srcPath
+				}
+			}
+			_, isLink := MD.Link()
+
 			switch {
 			case isSocket(fileMode):
 				debugf("skipping socket file: %v", srcPath)
 				return nil
+			case isLink:
+				fallthrough
 			case isCharDevice(fileMode):
 				fallthrough
 			case isDevice(fileMode):
@@ -196,12 +223,14 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 					return err
 				}
 				if !bytes.Equal(currentSig.Bytes(), thisSig.Bytes()) {
+					kind := archive.KindEntry
 					if currentSig.Len() != 0 {
+						kind = archive.KindChange
 						debugf("%q changed", srcPath)
 					} else {
 						debugf("%q new file", srcPath)
 					}
-					err = snap.Add(MD, nil, 0)
+					err = snap.Add(kind, MD, nil, 0)
 					if err != nil {
 						return err
 					}
@@ -229,7 +258,9 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 					return err
 				}
 				if !bytes.Equal(currentSig.Bytes(), thisSig.Bytes()) {
+					kind := archive.KindEntry
 					if currentSig.Len() != 0 {
+						kind = archive.KindChange
 						debugf("%q changed", srcPath)
 
 						delta.Reset()
@@ -242,7 +273,7 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 					} else {
 						debugf("%q new file", srcPath)
 					}
-					err = snap.Add(MD, dataReader, int64(dataReader.Len()))
+					err = snap.Add(kind, MD, dataReader, int64(dataReader.Len()))
 					if err != nil {
 						return err
 					}
@@ -271,7 +302,9 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 					return err
 				}
 				if !bytes.Equal(currentSig.Bytes(), thisSig.Bytes()) {
+					kind := archive.KindEntry
 					if currentSig.Len() != 0 {
+						kind = archive.KindChange
 						debugf("%q: changed", srcPath)
 						readBuffer.Reset(currentSig.Bytes())
 
@@ -301,7 +334,7 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 								srcFD.Close()
 								return err
 							}
-							err = snap.Add(MD, tmpFile, tmpFileInfo.Size())
+							err = snap.Add(kind, MD, tmpFile, tmpFileInfo.Size())
 							if err != nil {
 								tmpFile.Close()
 								os.Remove(tmpFile.Name())
@@ -320,7 +353,7 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 							}
 							readBuffer.Reset(delta.Bytes())
 
-							err = snap.Add(MD, readBuffer, int64(readBuffer.Len()))
+							err = snap.Add(kind, MD, readBuffer, int64(readBuffer.Len()))
 							readBuffer.Reset(nil)
 						}
 					} else {
@@ -330,7 +363,19 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 							srcFD.Close()
 							return err
 						}
-						err = snap.Add(MD, srcFD, st.Size())
+						extents, sparse, err := MD.Extents()
+						if err != nil {
+							srcFD.Close()
+							return err
+						}
+						var dataReader io.Reader = srcFD
+						dataLen := st.Size()
+						if sparse {
+							dataReader, dataLen = archive.ExtentsReader(srcFD, extents)
+							debugf("%q sparse: %d of %d bytes in %d extents",
+								srcPath, dataLen, st.Size(), len(extents))
+						}
+						err = snap.Add(kind, MD, dataReader, dataLen)
 						if err != nil {
 							srcFD.Close()
 							return err
@@ -368,7 +413,7 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 	// handle deleted files
 	for deletedFilePath := range pathsToCheck {
 		debugf("%q: deleted", deletedFilePath)
-		err = snap.Add(&Metadata{Path: deletedFilePath, Attribs: FileAttributes{}}, nil, 0)
+		err = snap.Delete(deletedFilePath)
 		if err != nil {
 			snap.Close()
 			os.Remove(snap.Name())
@@ -395,7 +440,9 @@ func backup(ctx context.Context, pubKey *stream.PublicKey, cfg *config) error {
 		sysLog.Err(fmt.Sprintf("failed to chown signature file %q: %v", sigFile, err))
 	}
 
-	sysLog.Info(fmt.Sprintf("completed: duration:%v bytes written:%d files-skipped:%d",
-		time.Since(startTime), snap.BytesWritten(), filesExcluded))
+	trailer := snap.Trailer()
+	sysLog.Info(fmt.Sprintf("completed: duration:%v bytes written:%d files-skipped:%d "+
+		"new:%d changed:%d deleted:%d", time.Since(startTime), snap.BytesWritten(),
+		filesExcluded, trailer.New, trailer.Changed, trailer.Deleted))
 	return nil
 }
@@ -1,164 +1,141 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"time"
 
 	"github.com/jrick/ss/stream"
-	"golang.org/x/sync/errgroup"
+	"golang.org/x/sys/unix"
+	"multus/archive"
 )
 
-func cat(ctx context.Context, secretKey *stream.SecretKey, file string) error {
-	dataFile, err := os.Open(file)
+func cat(ctx context.Context, secretKey *stream.SecretKey, file string, filter *pathFilter) error {
+	r, err := archive.Open(file, secretKey)
 	if err != nil {
 		return err
 	}
-	defer dataFile.Close()
 
-	header, err := stream.ReadHeader(dataFile)
-	if err != nil {
-		dataFile.Close()
-		return err
-	}
-	symKey, err := stream.Decapsulate(header, secretKey)
-	if err != nil {
-		dataFile.Close()
-		return err
+	fmt.Printf(" Hostname: %v\n", r.Header.Hostname)
+	fmt.Printf("Timestamp: %v\n", r.Header.Timestamp)
+	fmt.Printf("Increment: %d\n", r.Header.Increment)
+	if !r.Header.Created.IsZero() {
+		fmt.Printf("  Created: %v\n", r.Header.Created)
 	}
 
-	pipeR, pipeW := io.Pipe()
-	eg, ctx := errgroup.WithContext(ctx)
-	eg.Go(func() error {
-		defer dataFile.Close()
-		err = stream.Decrypt(pipeW, dataFile, header.Bytes, symKey)
+	if filter.selective() {
+		index, err := r.Index()
 		if err != nil {
-			pipeW.Close()
+			r.Close()
 			return err
 		}
-		return pipeW.Close()
-	})
-	dataFileGZ, err := gzip.NewReader(pipeR)
-	if err != nil {
-		pipeR.Close()
-		pipeW.Close()
-		return err
-	}
-	defer dataFileGZ.Close() // REMOVE
-
-	b := new(bytes.Buffer)
-	if _, err := io.CopyN(b, dataFileGZ, 3); err != nil {
-		dataFileGZ.Close()
-		pipeR.Close()
-		return err
-	}
-	hostLen := int64(b.Bytes()[2])
-	b.Reset()
-	if _, err := io.CopyN(b, dataFileGZ, hostLen+8+2); err != nil {
-		dataFileGZ.Close()
-		pipeR.Close()
-		return err
+		if index != nil {
+			// Seeking skips the trailer, so the whole increment
+			// is verified first.
+			if err = verifyIncrement(file, secretKey); err != nil {
+				r.Close()
+				return err
+			}
+			if err = catIndexed(ctx, r, index, filter); err != nil {
+				r.Close()
+				return err
+			}
+			return r.Close()
+		}
 	}
-	buf := b.Bytes()
-	hostname := string(buf[0:hostLen])
-	t := time.Unix(int64(binary.LittleEndian.Uint64(buf[hostLen:hostLen+8])), 0)
-	tmpInc := binary.LittleEndian.Uint16(buf[hostLen+8 : hostLen+8+2])
-
-	fmt.Printf(" Hostname: %v\n", hostname)
-	fmt.Printf("Timestamp: %v\n", t)
-	fmt.Printf("Increment: %d\n", tmpInc)
 
 	for {
 		if ctx.Err() != nil {
-			dataFileGZ.Close()
-			pipeR.Close()
+			r.Close()
 			return ctx.Err()
 		}
-		b.Reset()
-		if _, err := io.CopyN(b, dataFileGZ, 2); err != nil {
+		rec, err := r.Next()
+		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
-			dataFileGZ.Close()
-			pipeR.Close()
+			r.Close()
 			return err
 		}
-		pathLen := binary.LittleEndian.Uint16(b.Bytes()[0:2])
-		b.Reset()
-		if _, err := io.CopyN(b, dataFileGZ, int64(pathLen)); err != nil {
-			dataFileGZ.Close()
-			pipeR.Close()
-			return err
-		}
-		path := b.String()
-		b.Reset()
-		if _, err := io.CopyN(b, dataFileGZ, 36); err != nil {
-			dataFileGZ.Close()
-			pipeR.Close()
-			return err
-		}
-		var attrib FileAttributes
-		if err = attrib.Deserialize(b.Bytes()); err != nil {
-			dataFileGZ.Close()
-			pipeR.Close()
-			return err
+		if !filter.match(rec.Metadata.Path) {
+			continue
 		}
-		b.Reset()
+		catRecord(rec)
+	}
 
-		if _, err := io.CopyN(b, dataFileGZ, 8); err != nil {
-			dataFileGZ.Close()
-			pipeR.Close()
-			return err
-		}
-		dataLen := binary.LittleEndian.Uint64(b.Bytes()[0:8])
-		b.Reset()
+	if trailer := r.Trailer(); trailer != nil {
+		fmt.Printf("  Records: %d\n", trailer.Records)
+		fmt.Printf("     Data: %d\n", trailer.DataBytes)
+		fmt.Printf("      New: %d\n", trailer.New)
+		fmt.Printf("  Changed: %d\n", trailer.Changed)
+		fmt.Printf("  Deleted: %d\n", trailer.Deleted)
+	}
+
+	return r.Close()
+}
 
-		if attrib.IsEmpty() {
-			fmt.Printf("%q: delete\n", path)
+// catIndexed only decodes the blocks holding records selected by filter.
+func catIndexed(ctx context.Context, r *archive.Reader, index []archive.IndexEntry, filter *pathFilter) error {
+	// next is the record the reader is positioned at.
+	next := 0
+	for i, e := range index {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !filter.match(e.Path) {
 			continue
 		}
-
-		fileMode := os.FileMode(attrib.Mode)
-		switch {
-		case isSocket(fileMode):
-			fmt.Printf("%q: socket\n", path)
-		case isCharDevice(fileMode):
-			fmt.Printf("%q: character device\n", path)
-		case isDevice(fileMode):
-			fmt.Printf("%q: block device\n", path)
-		case isNamedPipe(fileMode):
-			fmt.Printf("%q: named pipe\n", path)
-		case isDir(fileMode):
-			fmt.Printf("%q: directory\n", path)
-		case isSymlink(fileMode):
-			fmt.Printf("%q: symlink (%d)\n", path, dataLen)
-		default:
-			fmt.Printf("%q: file (%d)\n", path, dataLen)
-			if _, err = io.CopyN(ioutil.Discard, dataFileGZ, int64(dataLen)); err != nil {
-				dataFileGZ.Close()
-				pipeR.Close()
+		if i != next {
+			if err := r.Seek(e); err != nil {
 				return err
 			}
-			continue
 		}
+		next = i + 1
+		rec, err := r.Next()
+		if err != nil {
+			return err
+		}
+		catRecord(rec)
 	}
-	if err := eg.Wait(); err != nil {
-		dataFileGZ.Close()
-		pipeR.Close()
-		return err
-	}
-	if err = dataFileGZ.Close(); err != nil {
-		pipeR.Close()
-		return err
+	return nil
+}
+
+func catRecord(rec *archive.Record) {
+	path := rec.Metadata.Path
+	if rec.Kind == archive.KindDelete {
+		fmt.Printf("%q: delete\n", path)
+		return
 	}
-	pipeR.Close()
 
-	return nil
+	fileMode := os.FileMode(rec.Metadata.Attribs.Mode)
+	rdev := rec.Metadata.Attribs.RDev
+	switch {
+	case isSocket(fileMode):
+		fmt.Printf("%q: socket\n", path)
+	case isCharDevice(fileMode):
+		fmt.Printf("%q: character device %d:%d\n", path,
+			unix.Major(rdev), unix.Minor(rdev))
+	case isDevice(fileMode):
+		fmt.Printf("%q: block device %d:%d\n", path,
+			unix.Major(rdev), unix.Minor(rdev))
+	case isNamedPipe(fileMode):
+		fmt.Printf("%q: named pipe\n", path)
+	case isDir(fileMode):
+		fmt.Printf("%q: directory\n", path)
+	case isSymlink(fileMode):
+		fmt.Printf("%q: symlink (%d)\n", path, rec.DataLen)
+	default:
+		if target, ok := rec.Metadata.Link(); ok {
+			fmt.Printf("%q: hard link to %q\n", path, target)
+			return
+		}
+		if _, sparse, _ := rec.Metadata.Extents(); sparse {
+			fmt.Printf("%q: sparse file (%d of %d)\n", path, rec.DataLen,
+				rec.Metadata.Attribs.Size)
+			return
+		}
+		fmt.Printf("%q: file (%d)\n", path, rec.DataLen)
+	}
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// conflictPolicy selects what restore does with a path of the destination
+// that it did not write itself.
+type conflictPolicy int
+
+const (
+	// conflictOverwrite removes the existing path.
+	conflictOverwrite conflictPolicy = iota
+
+	// conflictSkip leaves the existing path, and every later record of
+	// it, alone.
+	conflictSkip
+
+	// conflictRename moves the existing path aside.
+	conflictRename
+
+	// conflictFail aborts the restore.
+	conflictFail
+)
+
+func (c conflictPolicy) String() string {
+	switch c {
+	case conflictSkip:
+		return "skip-existing"
+	case conflictRename:
+		return "rename-existing"
+	case conflictFail:
+		return "fail-on-conflict"
+	default:
+		return "overwrite"
+	}
+}
+
+// fileState is the state a path was left in by a record of the restore.
+type fileState struct {
+	size int64
+	mtim int64
+	ino  uint64
+}
+
+func statFileState(st *unix.Stat_t) fileState {
+	return fileState{
+		size: st.Size,
+		mtim: st.Mtim.Nano(),
+		ino:  st.Ino,
+	}
+}
+
+// conflict reports whether restoring a record of mode to p would clobber
+// something the restore did not write, and returns the mode of the existing
+// path.  Existing directories are merged.
+func (rs *restorer) conflict(p *destPath, mode os.FileMode) (os.FileMode, bool, error) {
+	rs.mu.Lock()
+	_, written := rs.written[p.path]
+	rs.mu.Unlock()
+	if written {
+		return 0, false, nil
+	}
+	st, err := p.lstat()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	existing := statMode(st.Mode)
+	if isDir(existing) && isDir(mode) {
+		return existing, false, nil
+	}
+	return existing, true, nil
+}
+
+// resolveConflict applies the conflict policy to the existing path and
+// reports whether the record must be skipped.
+func (rs *restorer) resolveConflict(p *destPath, existing os.FileMode) (bool, error) {
+	switch rs.policy {
+	case conflictSkip:
+		log.Printf("%q: skipping existing %s", p.path, fileType(existing))
+		rs.mu.Lock()
+		rs.skipped[p.path] = struct{}{}
+		rs.mu.Unlock()
+		return true, nil
+	case conflictRename:
+		aside, err := p.asideName()
+		if err != nil {
+			return false, err
+		}
+		if err = p.renameTo(aside); err != nil {
+			return false, err
+		}
+		log.Printf("%q: renamed existing %s to %q", p.path,
+			fileType(existing), filepath.Join(filepath.Dir(p.path), aside))
+		return false, nil
+	case conflictFail:
+		return false, fmt.Errorf("%q: %s already exists", p.path,
+			fileType(existing))
+	default:
+		log.Printf("%q: overwriting existing %s", p.path, fileType(existing))
+		// Directories are only removed when empty.
+		return false, p.remove()
+	}
+}
+
+// asideName returns the first free name of p.orig, p.orig.1, and so on in
+// the parent directory of p.
+func (p *destPath) asideName() (string, error) {
+	aside := p.name + ".orig"
+	for i := 1; ; i++ {
+		var st unix.Stat_t
+		err := unix.Fstatat(p.dir, aside, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if errors.Is(err, unix.ENOENT) {
+			return aside, nil
+		}
+		if err != nil {
+			return "", &os.PathError{Op: "lstat",
+				Path: filepath.Join(filepath.Dir(p.path), aside), Err: err}
+		}
+		aside = fmt.Sprintf("%s.orig.%d", p.name, i)
+	}
+}
+
+// checkBasis verifies that p is still what an earlier level of this restore
+// left behind before a delta is applied to it.  Patching anything else
+// silently produces garbage.
+func (rs *restorer) checkBasis(p *destPath) error {
+	rs.mu.Lock()
+	want, ok := rs.written[p.path]
+	rs.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%q: patch basis was not restored by an earlier "+
+			"level", p.path)
+	}
+	st, err := p.lstat()
+	if err != nil {
+		return err
+	}
+	if cur := statFileState(&st); cur != want {
+		return fmt.Errorf("%q: patch basis changed since it was restored "+
+			"(size %d, mtime %v; expected size %d, mtime %v)", p.path,
+			cur.size, time.Unix(0, cur.mtim), want.size,
+			time.Unix(0, want.mtim))
+	}
+	return nil
+}
+
+// markWritten records the state p was left in.
+func (rs *restorer) markWritten(p *destPath) error {
+	st, err := p.lstat()
+	if err != nil {
+		if os.IsNotExist(err) {
+			// The record was skipped, e.g. a device node restored
+			// without privileges.
+			return nil
+		}
+		return err
+	}
+	rs.mu.Lock()
+	rs.written[p.path] = statFileState(&st)
+	rs.mu.Unlock()
+	return nil
+}
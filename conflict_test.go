@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readFiles returns the contents of the files named in want below dir,
+// with "" for missing ones.
+func readFiles(t *testing.T, dir string, want map[string]string) map[string]string {
+	t.Helper()
+	got := make(map[string]string)
+	for name := range want {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		got[name] = string(b)
+	}
+	return got
+}
+
+func TestRestoreConflict(t *testing.T) {
+	tb := newTestBackup(t)
+	tb.write("a", []byte("backed up\n"), 0o644)
+	tb.backup()
+
+	tests := []struct {
+		policy conflictPolicy
+		fail   bool
+		want   map[string]string
+	}{{
+		policy: conflictOverwrite,
+		want:   map[string]string{"a": "backed up\n", "a.orig": "older\n"},
+	}, {
+		policy: conflictSkip,
+		want:   map[string]string{"a": "existing\n", "a.orig": "older\n"},
+	}, {
+		policy: conflictRename,
+		want: map[string]string{"a": "backed up\n", "a.orig": "older\n",
+			"a.orig.1": "existing\n"},
+	}, {
+		policy: conflictFail,
+		fail:   true,
+		want:   map[string]string{"a": "existing\n", "a.orig": "older\n"},
+	}}
+	for _, test := range tests {
+		t.Run(test.policy.String(), func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "dest")
+			dir := dest + tb.src
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			for name, data := range map[string]string{
+				"a":      "existing\n",
+				"a.orig": "older\n",
+			} {
+				err := os.WriteFile(filepath.Join(dir, name),
+					[]byte(data), 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := restore(context.Background(), tb.secretKey,
+				tb.cfg.BackupPath, dest, nil, 0,
+				restoreOptions{conflict: test.policy})
+			if test.fail {
+				if err == nil || !strings.Contains(err.Error(),
+					"already exists") {
+					t.Fatalf("got %v, want a conflict", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			got := readFiles(t, dir, test.want)
+			for name, want := range test.want {
+				if got[name] != want {
+					t.Errorf("%s: got %q, want %q", name,
+						got[name], want)
+				}
+			}
+		})
+	}
+}
+
+// TestConflictSymlinkParent checks that conflicts are never looked up
+// through a symlinked directory of the destination.
+func TestConflictSymlinkParent(t *testing.T) {
+	tb := newTestBackup(t)
+	tb.write("d/a", []byte("backed up\n"), 0o644)
+	tb.backup()
+
+	tests := []struct {
+		name string
+		// link is the path of the symlink below the destination.
+		link string
+		err  error
+	}{
+		// The parent of the backed up directory is not in the
+		// archive, so the restore refuses to go through it.
+		{"parent", filepath.Dir(tb.src), errEscape},
+		// The restored directory d replaces the symlink, which is
+		// renamed aside.
+		{"restored", tb.path("d"), nil},
+	}
+	for _, test := range tests {
+		for _, dryRun := range []bool{false, true} {
+			outside := t.TempDir()
+			for _, name := range []string{"a", filepath.Base(tb.src)} {
+				err := os.WriteFile(filepath.Join(outside, name),
+					[]byte("outside\n"), 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			dest := filepath.Join(t.TempDir(), "dest")
+			link := dest + test.link
+			if err := os.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(outside, link); err != nil {
+				t.Fatal(err)
+			}
+
+			err := restore(context.Background(), tb.secretKey,
+				tb.cfg.BackupPath, dest, nil, 0,
+				restoreOptions{dryRun: dryRun, conflict: conflictRename})
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s, dry run %v: got %v, want %v", test.name,
+					dryRun, err, test.err)
+			}
+			entries, err := os.ReadDir(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 {
+				t.Errorf("%s, dry run %v: %d entries outside of "+
+					"the destination", test.name, dryRun,
+					len(entries))
+			}
+		}
+	}
+}
+
+func TestCheckBasis(t *testing.T) {
+	dest := t.TempDir()
+	rs := newRestorer(dest, &pathRewriter{}, conflictOverwrite)
+	file := filepath.Join(dest, "f")
+	if err := os.WriteFile(file, []byte("restored\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := rs.dest.open("f", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	err = rs.checkBasis(p)
+	if err == nil || !strings.Contains(err.Error(), "not restored") {
+		t.Fatalf("unrestored basis: got %v", err)
+	}
+	if err = rs.markWritten(p); err != nil {
+		t.Fatal(err)
+	}
+	if err = rs.checkBasis(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing the file changes its inode, appending changes its size.
+	for _, change := range []func() error{
+		func() error {
+			tmp := file + ".tmp"
+			err := os.WriteFile(tmp, []byte("replaced\n"), 0o644)
+			if err != nil {
+				return err
+			}
+			return os.Rename(tmp, file)
+		},
+		func() error {
+			f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				return err
+			}
+			if _, err = f.WriteString("appended\n"); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		},
+	} {
+		if err = change(); err != nil {
+			t.Fatal(err)
+		}
+		err = rs.checkBasis(p)
+		if err == nil || !strings.Contains(err.Error(), "changed") {
+			t.Errorf("changed basis: got %v", err)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// errEscape is returned for archive paths that would resolve outside of the
+// restore destination.
+var errEscape = errors.New("path escapes the restore destination")
+
+// destination resolves archive paths below the root of a restore.  Every
+// directory below the root is opened relative to its parent with O_NOFOLLOW,
+// so neither a ".." component nor a symlink, whether it was restored by an
+// earlier record or was already there, can lead outside of it.
+type destination struct {
+	root string
+}
+
+// checkPath rejects archive paths with ".." or NUL bytes.
+func checkPath(path string) error {
+	if strings.IndexByte(path, 0) >= 0 {
+		return fmt.Errorf("%q: invalid path", path)
+	}
+	for _, c := range strings.Split(path, "/") {
+		if c == ".." {
+			return &os.PathError{Op: "restore", Path: path, Err: errEscape}
+		}
+	}
+	return nil
+}
+
+// components splits a checked archive path into its non-empty components.
+func components(path string) []string {
+	var comps []string
+	for _, c := range strings.Split(path, "/") {
+		if c != "" && c != "." {
+			comps = append(comps, c)
+		}
+	}
+	return comps
+}
+
+// open returns the archive path p with its parent directory opened.  Missing
+// parents are created when create is set.
+func (d *destination) open(p string, create bool) (*destPath, error) {
+	if err := checkPath(p); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(d.root, p)
+	if create {
+		if err := os.MkdirAll(d.root, 0o0755); err != nil {
+			return nil, err
+		}
+	}
+	dir, err := unix.Open(d.root, unix.O_RDONLY|unix.O_DIRECTORY|
+		unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: d.root, Err: err}
+	}
+
+	comps := components(p)
+	if len(comps) == 0 {
+		// The root of the destination itself.
+		return &destPath{dir: dir, name: ".", path: path}, nil
+	}
+	parent := d.root
+	for _, c := range comps[:len(comps)-1] {
+		parent = filepath.Join(parent, c)
+		fd, err := openDir(dir, c)
+		if errors.Is(err, unix.ENOENT) && create {
+			err = unix.Mkdirat(dir, c, 0o0755)
+			if err == nil || errors.Is(err, unix.EEXIST) {
+				fd, err = openDir(dir, c)
+			}
+		}
+		if errors.Is(err, unix.ELOOP) || errors.Is(err, unix.ENOTDIR) {
+			var st unix.Stat_t
+			serr := unix.Fstatat(dir, c, &st, unix.AT_SYMLINK_NOFOLLOW)
+			if serr == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK {
+				unix.Close(dir)
+				return nil, fmt.Errorf("%q: %w: %q is a symlink",
+					path, errEscape, parent)
+			}
+		}
+		unix.Close(dir)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: parent, Err: err}
+		}
+		dir = fd
+	}
+	return &destPath{dir: dir, name: comps[len(comps)-1], path: path}, nil
+}
+
+func openDir(dir int, name string) (int, error) {
+	return unix.Openat(dir, name, unix.O_RDONLY|unix.O_DIRECTORY|
+		unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+}
+
+// destPath is a path of the destination whose parent directory is held
+// open.  Its methods operate on the final component relative to the parent
+// and never follow it when it is a symlink.
+type destPath struct {
+	dir  int
+	name string
+	path string
+}
+
+func (p *destPath) Close() error {
+	return unix.Close(p.dir)
+}
+
+func (p *destPath) pathError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: p.path, Err: err}
+}
+
+func (p *destPath) lstat() (unix.Stat_t, error) {
+	var st unix.Stat_t
+	err := unix.Fstatat(p.dir, p.name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	return st, p.pathError("lstat", err)
+}
+
+// remove removes the path when it is a file or an empty directory.
+func (p *destPath) remove() error {
+	err := unix.Unlinkat(p.dir, p.name, 0)
+	if errors.Is(err, unix.EISDIR) {
+		err = unix.Unlinkat(p.dir, p.name, unix.AT_REMOVEDIR)
+	}
+	return p.pathError("remove", err)
+}
+
+// openFile opens the path, or a sibling of it with the suffix appended to
+// its name, with O_NOFOLLOW.
+func (p *destPath) openFile(suffix string, flag int, perm uint32) (*os.File, error) {
+	fd, err := unix.Openat(p.dir, p.name+suffix, flag|unix.O_NOFOLLOW|
+		unix.O_CLOEXEC, perm)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p.path + suffix, Err: err}
+	}
+	return os.NewFile(uintptr(fd), p.path+suffix), nil
+}
+
+// rename replaces the path with its sibling with the suffix appended to
+// its name.
+func (p *destPath) rename(suffix string) error {
+	err := unix.Renameat(p.dir, p.name+suffix, p.dir, p.name)
+	return p.pathError("rename", err)
+}
+
+// renameTo moves the path to a sibling named name.
+func (p *destPath) renameTo(name string) error {
+	err := unix.Renameat(p.dir, p.name, p.dir, name)
+	return p.pathError("rename", err)
+}
+
+func (p *destPath) mkdir(perm uint32) error {
+	return p.pathError("mkdir", unix.Mkdirat(p.dir, p.name, perm))
+}
+
+func (p *destPath) mknod(mode uint32, dev int) error {
+	return p.pathError("mknod", unix.Mknodat(p.dir, p.name, mode, dev))
+}
+
+func (p *destPath) symlink(target string) error {
+	return p.pathError("symlink", unix.Symlinkat(target, p.dir, p.name))
+}
+
+func (p *destPath) readlink() (string, error) {
+	for size := 256; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(p.dir, p.name, buf)
+		if err != nil {
+			return "", p.pathError("readlink", err)
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// link makes the path a hard link to target.
+func (p *destPath) link(target *destPath) error {
+	err := unix.Linkat(target.dir, target.name, p.dir, p.name, 0)
+	return p.pathError("link", err)
+}
+
+// chmod sets the permission, setuid, setgid and sticky bits of the path,
+// which must not be a symlink.
+func (p *destPath) chmod(mode os.FileMode) error {
+	return p.pathError("chmod", unix.Fchmodat(p.dir, p.name, unixMode(mode), 0))
+}
+
+func (p *destPath) lchown(uid, gid int) error {
+	err := unix.Fchownat(p.dir, p.name, uid, gid, unix.AT_SYMLINK_NOFOLLOW)
+	return p.pathError("lchown", err)
+}
+
+// lchtimes sets the access and modification times of the path to mtim
+// nanoseconds since the epoch.
+func (p *destPath) lchtimes(mtim int64) error {
+	ts := unix.NsecToTimespec(mtim)
+	err := unix.UtimesNanoAt(p.dir, p.name, []unix.Timespec{ts, ts},
+		unix.AT_SYMLINK_NOFOLLOW)
+	return p.pathError("lchtimes", err)
+}
+
+// unixMode returns the permission, setuid, setgid and sticky bits of mode.
+func unixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= unix.S_ISVTX
+	}
+	return m
+}
+
+// statMode returns the file type and permissions of a raw stat mode.
+func statMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0o0777)
+	switch m & unix.S_IFMT {
+	case unix.S_IFDIR:
+		mode |= os.ModeDir
+	case unix.S_IFLNK:
+		mode |= os.ModeSymlink
+	case unix.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case unix.S_IFSOCK:
+		mode |= os.ModeSocket
+	case unix.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case unix.S_IFBLK:
+		mode |= os.ModeDevice
+	}
+	return mode
+}
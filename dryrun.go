@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"multus/archive"
+)
+
+// restorePlan reports the actions a restore would take.  The destination is
+// only read: the outcome of earlier records is tracked in state so that later
+// increments are compared against what the restore would have left behind.
+type restorePlan struct {
+	destDir string
+	dest    destination
+	paths   *pathRewriter
+	policy  conflictPolicy
+
+	// state maps a destination path to its planned attributes.  A nil
+	// value means the path would have been deleted.
+	state map[string]*archive.FileAttributes
+
+	// skipped holds the existing paths left alone by conflictSkip.
+	skipped map[string]struct{}
+
+	// replaced holds the existing paths that would be removed or renamed,
+	// below which nothing of the destination is left.
+	replaced map[string]struct{}
+
+	created int
+	patched int
+	deleted int
+	bytes   int64
+}
+
+func newRestorePlan(destDir string, paths *pathRewriter, policy conflictPolicy) *restorePlan {
+	return &restorePlan{
+		destDir:  destDir,
+		dest:     destination{root: destDir},
+		paths:    paths,
+		policy:   policy,
+		state:    make(map[string]*archive.FileAttributes),
+		skipped:  make(map[string]struct{}),
+		replaced: make(map[string]struct{}),
+	}
+}
+
+// current returns the attributes path, the destination path of relPath,
+// would have at this point of the restore, or nil when it would not exist.
+// Like restore, it never follows a symlink below the destination.
+func (p *restorePlan) current(relPath, path string) (*archive.FileAttributes, error) {
+	if attrib, ok := p.state[path]; ok {
+		return attrib, nil
+	}
+	for dir := filepath.Dir(path); len(dir) > len(p.destDir); dir = filepath.Dir(dir) {
+		if _, ok := p.replaced[dir]; ok {
+			return nil, nil
+		}
+	}
+	dp, err := p.dest.open(relPath, false)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer dp.Close()
+	st, err := dp.lstat()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &archive.FileAttributes{
+		Size: st.Size,
+		MTim: st.Mtim.Nano(),
+		Mode: uint32(statMode(st.Mode)),
+		UID:  st.Uid,
+		GID:  st.Gid,
+	}, nil
+}
+
+func (p *restorePlan) record(r *archive.Reader, i int, rec *archive.Record) error {
+	if err := checkPath(rec.Metadata.Path); err != nil {
+		return err
+	}
+	if target, ok := rec.Metadata.Link(); ok {
+		if err := checkPath(target); err != nil {
+			return err
+		}
+	}
+	relPath, ok := p.paths.rewrite(rec.Metadata.Path)
+	if !ok {
+		return nil
+	}
+	path := filepath.Join(p.destDir, relPath)
+	if _, ok := p.skipped[path]; ok {
+		return nil
+	}
+	_, planned := p.state[path]
+	cur, err := p.current(relPath, path)
+	if err != nil {
+		return err
+	}
+
+	var mode os.FileMode
+	if rec.Kind != archive.KindDelete {
+		mode = os.FileMode(rec.Metadata.Attribs.Mode)
+	}
+	var actions []string
+	if !planned && cur != nil &&
+		!(isDir(os.FileMode(cur.Mode)) && isDir(mode)) {
+		existing := fileType(os.FileMode(cur.Mode))
+		switch p.policy {
+		case conflictSkip:
+			fmt.Printf("%q: skip existing %s\n", path, existing)
+			p.skipped[path] = struct{}{}
+			return nil
+		case conflictRename:
+			dp, err := p.dest.open(relPath, false)
+			if err != nil {
+				return err
+			}
+			aside, err := dp.asideName()
+			dp.Close()
+			if err != nil {
+				return err
+			}
+			actions = append(actions, fmt.Sprintf("rename existing %s "+
+				"to %q", existing, filepath.Join(filepath.Dir(path), aside)))
+		case conflictFail:
+			return fmt.Errorf("%q: %s already exists", path, existing)
+		default:
+			actions = append(actions, fmt.Sprintf("remove existing %s",
+				existing))
+		}
+		p.replaced[path] = struct{}{}
+		cur = nil
+	}
+
+	if rec.Kind == archive.KindDelete {
+		if cur == nil {
+			if len(actions) > 0 {
+				fmt.Printf("%q: %s\n", path, strings.Join(actions, ", "))
+				p.state[path] = nil
+			}
+			return nil
+		}
+		fmt.Printf("%q: delete\n", path)
+		p.replaced[path] = struct{}{}
+		p.deleted++
+		p.state[path] = nil
+		return nil
+	}
+
+	attrib := rec.Metadata.Attribs
+	fileMode := os.FileMode(attrib.Mode)
+	delta := rec.Kind == archive.KindChange
+	if r.Header.Version < archive.Version2 {
+		delta = planned && cur != nil
+	}
+	_, isLink := rec.Metadata.Link()
+	if delta && !isLink && !planned &&
+		(fileMode.IsRegular() || isSymlink(fileMode)) {
+		return fmt.Errorf("%q: patch basis was not restored by an "+
+			"earlier level", path)
+	}
+	switch {
+	case cur == nil || os.FileMode(cur.Mode).Type() != fileMode.Type():
+		action := fmt.Sprintf("create %s", fileType(fileMode))
+		if target, ok := rec.Metadata.Link(); ok {
+			action = p.linkAction(target)
+		} else if rec.DataLen > 0 {
+			action += fmt.Sprintf(" (%d bytes)", rec.DataLen)
+		}
+		actions = append(actions, action)
+		p.created++
+	default:
+		target, _ := rec.Metadata.Link()
+		switch {
+		case isLink:
+			actions = append(actions, p.linkAction(target))
+		case !fileMode.IsRegular() && !isSymlink(fileMode):
+		case delta:
+			actions = append(actions, fmt.Sprintf("patch (%d bytes)",
+				rec.DataLen))
+			p.patched++
+		default:
+			actions = append(actions, fmt.Sprintf("replace (%d bytes)",
+				rec.DataLen))
+			p.created++
+		}
+		if fileMode.Perm() != os.FileMode(cur.Mode).Perm() &&
+			!isSymlink(fileMode) {
+			actions = append(actions, fmt.Sprintf("chmod %v",
+				fileMode.Perm()))
+		}
+		if attrib.UID != cur.UID || attrib.GID != cur.GID {
+			actions = append(actions, fmt.Sprintf("chown %d:%d",
+				attrib.UID, attrib.GID))
+		}
+	}
+	p.bytes += rec.DataLen
+	p.state[path] = &attrib
+
+	if len(actions) > 0 {
+		fmt.Printf("%q: %s\n", path, strings.Join(actions, ", "))
+	}
+	return nil
+}
+
+// linkAction describes the hard link to the archive path target.  The
+// contents of targets that are not restored are copied instead.
+func (p *restorePlan) linkAction(target string) string {
+	if mapped, ok := p.paths.mapPath(target); ok {
+		path := filepath.Join(p.destDir, mapped)
+		if attrib := p.state[path]; attrib != nil {
+			return fmt.Sprintf("link to %q", path)
+		}
+	}
+	return fmt.Sprintf("copy the contents of %q", target)
+}
+
+func (p *restorePlan) summary() {
+	fmt.Printf("dry run: %d created, %d patched, %d deleted, %d bytes\n",
+		p.created, p.patched, p.deleted, p.bytes)
+}
+
+func fileType(fileMode os.FileMode) string {
+	switch {
+	case isSocket(fileMode):
+		return "socket"
+	case isCharDevice(fileMode):
+		return "character device"
+	case isDevice(fileMode):
+		return "block device"
+	case isNamedPipe(fileMode):
+		return "named pipe"
+	case isDir(fileMode):
+		return "directory"
+	case isSymlink(fileMode):
+		return "symlink"
+	default:
+		return "file"
+	}
+}
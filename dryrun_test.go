@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// snapshotTree returns the paths below dir along with their mode, size,
+// mtime and contents.
+func snapshotTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var data []byte
+		if fi.Mode().IsRegular() {
+			if data, err = os.ReadFile(path); err != nil {
+				return err
+			}
+		}
+		tree[path] = fmt.Sprintf("%v %d %v %q", fi.Mode(), fi.Size(),
+			fi.ModTime().UnixNano(), data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestDryRun(t *testing.T) {
+	tb := newTestBackup(t)
+	a := bytes.Repeat([]byte("patched at level 1\n"), 1024)
+	tb.write("a", a, 0o644)
+	tb.write("b", []byte("deleted at level 1\n"), 0o644)
+	if err := os.Mkdir(tb.path("d"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tb.backup()
+	copy(a[100:], "level 1")
+	tb.write("a", a, 0o600)
+	if err := os.Remove(tb.path("b")); err != nil {
+		t.Fatal(err)
+	}
+	tb.write("c", []byte("created at level 1\n"), 0o644)
+	tb.backup()
+
+	dryRun := func(dest string, policy conflictPolicy) string {
+		t.Helper()
+		out, err := stdout(t, func() error {
+			return restore(context.Background(), tb.secretKey,
+				tb.cfg.BackupPath, dest, nil, -1,
+				restoreOptions{dryRun: true, conflict: policy})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	contains := func(out string, want ...string) {
+		t.Helper()
+		for _, w := range want {
+			if !strings.Contains(out, w) {
+				t.Errorf("output lacks %q:\n%s", w, out)
+			}
+		}
+	}
+
+	// An empty destination is not even created.
+	dest := filepath.Join(t.TempDir(), "dest")
+	out := dryRun(dest, conflictOverwrite)
+	path := func(name string) string {
+		return dest + tb.path(name)
+	}
+	contains(out,
+		fmt.Sprintf("%q: create directory\n", dest+tb.src),
+		fmt.Sprintf("%q: create file (%d bytes)\n", path("a"), len(a)),
+		fmt.Sprintf("%q: patch (", path("a")),
+		"chmod -rw-------\n",
+		fmt.Sprintf("%q: create file (19 bytes)\n", path("b")),
+		fmt.Sprintf("%q: delete\n", path("b")),
+		fmt.Sprintf("%q: create file (19 bytes)\n", path("c")),
+		fmt.Sprintf("%q: create directory\n", path("d")),
+		"dry run: 5 created, 1 patched, 1 deleted, ")
+	if _, err := os.Lstat(dest); !os.IsNotExist(err) {
+		t.Errorf("destination created: %v", err)
+	}
+
+	// Existing paths are reported as conflicts and left alone.
+	if err := os.MkdirAll(path("d"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path("a"), []byte("existing\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before := snapshotTree(t, dest)
+	contains(dryRun(dest, conflictOverwrite),
+		fmt.Sprintf("%q: remove existing file, create file", path("a")),
+		fmt.Sprintf("%q: chmod -rwxr-xr-x\n", path("d")))
+	contains(dryRun(dest, conflictSkip),
+		fmt.Sprintf("%q: skip existing file\n", path("a")))
+	contains(dryRun(dest, conflictRename),
+		fmt.Sprintf("%q: rename existing file to %q, create file",
+			path("a"), path("a")+".orig"))
+	_, err := stdout(t, func() error {
+		return restore(context.Background(), tb.secretKey,
+			tb.cfg.BackupPath, dest, nil, -1,
+			restoreOptions{dryRun: true, conflict: conflictFail})
+	})
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("fail-on-conflict: got %v, want a conflict", err)
+	}
+	after := snapshotTree(t, dest)
+	if fmt.Sprint(before) != fmt.Sprint(after) {
+		t.Errorf("destination changed:\n%v\n%v", before, after)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// pathFilter selects archive paths by include and exclude patterns and a
+// list of paths.  A path is selected when it matches an include pattern or
+// lies below a listed path, or when there are neither, and matches no
+// exclude pattern.
+type pathFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	files   map[string]struct{}
+}
+
+// filterFlags adds the flags selecting paths to fs.
+func filterFlags(fs *flag.FlagSet, f *pathFilter) {
+	fs.Func("include", "only select paths matching the glob, or the "+
+		"regexp prefixed with re: (repeatable)", f.addInclude)
+	fs.Func("exclude", "skip paths matching the glob, or the regexp "+
+		"prefixed with re: (repeatable)", f.addExclude)
+	fs.Func("files-from", "only select the paths listed in file, one "+
+		"per line", f.readFiles)
+}
+
+func (f *pathFilter) addInclude(s string) error {
+	re, err := compilePattern(s)
+	if err != nil {
+		return err
+	}
+	f.include = append(f.include, re)
+	return nil
+}
+
+func (f *pathFilter) addExclude(s string) error {
+	re, err := compilePattern(s)
+	if err != nil {
+		return err
+	}
+	f.exclude = append(f.exclude, re)
+	return nil
+}
+
+// addRegexp adds an include regexp given as a positional argument.
+func (f *pathFilter) addRegexp(s string) error {
+	return f.addInclude("re:" + s)
+}
+
+// readFiles adds the absolute paths listed in file.  Blank lines and lines
+// starting with # are ignored.
+func (f *pathFilter) readFiles(file string) error {
+	fd, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	if f.files == nil {
+		f.files = make(map[string]struct{})
+	}
+	s := bufio.NewScanner(fd)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		path, err := absPath(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", file, n, err)
+		}
+		f.files[path] = struct{}{}
+	}
+	return s.Err()
+}
+
+// selective reports whether some paths are not selected.  A nil filter
+// selects every path.
+func (f *pathFilter) selective() bool {
+	return f != nil && (len(f.include) > 0 || len(f.exclude) > 0 ||
+		f.files != nil)
+}
+
+// match reports whether path is selected.
+func (f *pathFilter) match(path string) bool {
+	if !f.selective() {
+		return true
+	}
+	if len(f.include) > 0 || f.files != nil {
+		if !f.listed(path) && !matchAny(f.include, path) {
+			return false
+		}
+	}
+	return !matchAny(f.exclude, path)
+}
+
+// listed reports whether path or one of its parents was listed.
+func (f *pathFilter) listed(path string) bool {
+	if f.files == nil {
+		return false
+	}
+	for {
+		if _, ok := f.files[path]; ok {
+			return true
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return false
+		}
+		path = parent
+	}
+}
+
+func matchAny(res []*regexp.Regexp, path string) bool {
+	for _, re := range res {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// compilePattern compiles a pattern given on the command line: a regexp
+// when prefixed with re:, a glob otherwise.
+func compilePattern(s string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(s, "re:") {
+		return regexp.Compile(s[len("re:"):])
+	}
+	return globRegexp(s)
+}
+
+// globRegexp converts a shell glob to a regexp.  * and ? match within a
+// path component and ** matches across them.  A glob starting with / is
+// anchored at the root, any other one matches the trailing components of a
+// path.  The paths below a matching directory match too.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	if glob == "" {
+		return nil, errors.New("empty glob")
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	if strings.HasPrefix(glob, "/") {
+		glob = strings.Trim(glob, "/")
+		if glob == "" {
+			// The root matches everything.
+			return regexp.Compile("^/")
+		}
+		b.WriteString("/")
+	} else {
+		glob = strings.TrimRight(glob, "/")
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// **/ matches zero or more directories.
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%q: missing ]", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if class == "" {
+				return nil, fmt.Errorf("%q: empty character class", glob)
+			}
+			if class[0] == '!' || class[0] == '^' {
+				// Negated classes do not match across
+				// components either.
+				class = "^/" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				c = glob[i]
+			}
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("(?:/.*)?$")
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		path  string
+		match bool
+	}{
+		// Unanchored globs match the trailing components.
+		{"*.o", "/a.o", true},
+		{"*.o", "/src/lib/a.o", true},
+		{"*.o", "/src/a.oo", false},
+		{"*.o", "/src/a.o/b", true},
+		{"lib/*.o", "/src/lib/a.o", true},
+		{"lib/*.o", "/src/xlib/a.o", false},
+		{"b", "/a/b", true},
+		{"b", "/a/bb", false},
+
+		// * and ? stay within a component.
+		{"/a/*", "/a/b", true},
+		{"/a/*", "/a/b/c", true},
+		{"/a/*/c", "/a/b/x/c", false},
+		{"/a/?", "/a/b", true},
+		{"/a/?", "/a/bc", false},
+		{"/a?b", "/a/b", false},
+
+		// ** matches across components.
+		{"/a/**/c", "/a/c", true},
+		{"/a/**/c", "/a/b/x/c", true},
+		{"/a/**", "/a/b/c", true},
+		{"/a**", "/ab/c", true},
+		{"**/c", "/a/b/c", true},
+
+		// Anchored globs match from the root.
+		{"/a", "/a", true},
+		{"/a", "/a/b", true},
+		{"/a", "/x/a", false},
+		{"/a", "/ab", false},
+		{"/", "/anything", true},
+
+		// A trailing / is ignored.
+		{"/a/", "/a", true},
+		{"/a/", "/a/b", true},
+		{"b/", "/a/b", true},
+
+		// Character classes.
+		{"/[ab]", "/a", true},
+		{"/[ab]", "/c", false},
+		{"/[a-c]x", "/bx", true},
+		{"/[!a]", "/b", true},
+		{"/[!a]", "/a", false},
+		{"/a[!x]b", "/a/b", false},
+		{"/a[^x]b", "/a/b", false},
+
+		// Escapes and metacharacters are literal.
+		{`/a\*`, "/a*", true},
+		{`/a\*`, "/ab", false},
+		{"/a.b", "/axb", false},
+		{"/a+b", "/a+b", true},
+	}
+	for _, tt := range tests {
+		re, err := globRegexp(tt.glob)
+		if err != nil {
+			t.Errorf("%q: %v", tt.glob, err)
+			continue
+		}
+		if got := re.MatchString(tt.path); got != tt.match {
+			t.Errorf("%q matches %q: %v, want %v", tt.glob, tt.path, got,
+				tt.match)
+		}
+	}
+
+	for _, glob := range []string{"", "/a[", "/a[]"} {
+		if _, err := globRegexp(glob); err == nil {
+			t.Errorf("%q: no error", glob)
+		}
+	}
+}
+
+func TestPathFilter(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "files")
+	err := os.WriteFile(list, []byte("# listed paths\n/etc/ssh\n\n/home/a/notes\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		includes []string
+		excludes []string
+		files    string
+		match    map[string]bool
+	}{{
+		name: "none",
+		match: map[string]bool{
+			"/etc/passwd": true,
+		},
+	}, {
+		name:     "include",
+		includes: []string{"/etc", "*.conf"},
+		match: map[string]bool{
+			"/etc/passwd":    true,
+			"/usr/a.conf":    true,
+			"/usr/bin/true":  false,
+			"/etcetera/file": false,
+		},
+	}, {
+		name:     "exclude",
+		excludes: []string{"*.o", "re:^/tmp/"},
+		match: map[string]bool{
+			"/src/a.c": true,
+			"/src/a.o": false,
+			"/tmp/x":   false,
+			"/tmp":     true,
+		},
+	}, {
+		name:     "exclude wins over include",
+		includes: []string{"/src"},
+		excludes: []string{"*.o"},
+		match: map[string]bool{
+			"/src/a.c": true,
+			"/src/a.o": false,
+			"/usr/a.c": false,
+		},
+	}, {
+		name:  "files",
+		files: list,
+		match: map[string]bool{
+			"/etc/ssh":               true,
+			"/etc/ssh/sshd_config":   true,
+			"/etc/sshd":              false,
+			"/etc":                   false,
+			"/home/a/notes":          true,
+			"/home/a/notes.bak":      false,
+			"/home/a/notes/2024.txt": true,
+		},
+	}, {
+		name:     "files or include, less excludes",
+		includes: []string{"/usr/bin"},
+		excludes: []string{"sshd_config"},
+		files:    list,
+		match: map[string]bool{
+			"/etc/ssh/moduli":      true,
+			"/etc/ssh/sshd_config": false,
+			"/usr/bin/true":        true,
+			"/usr/lib":             false,
+		},
+	}}
+	for _, tt := range tests {
+		f := new(pathFilter)
+		for _, s := range tt.includes {
+			if err := f.addInclude(s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, s := range tt.excludes {
+			if err := f.addExclude(s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.files != "" {
+			if err := f.readFiles(tt.files); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if f.selective() != (tt.name != "none") {
+			t.Errorf("%s: selective %v", tt.name, f.selective())
+		}
+		for path, want := range tt.match {
+			if got := f.match(path); got != want {
+				t.Errorf("%s: %q selected %v, want %v", tt.name, path,
+					got, want)
+			}
+		}
+	}
+
+	var f *pathFilter
+	if f.selective() || !f.match("/a") {
+		t.Error("nil filter does not select every path")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jrick/ss/stream"
+	"github.com/smtc/rsync"
+	"multus/archive"
+)
+
+// get writes the contents of the regular file, or the target of the
+// symlink, path as of level to w.
+func get(ctx context.Context, secretKey *stream.SecretKey, sourceDir string, level int32, opts snapshotOptions, path string, w io.Writer) error {
+	snapID, chain, err := selectChain(ctx, secretKey, sourceDir, level, opts)
+	if err != nil {
+		return err
+	}
+	f, err := rebuild(ctx, secretKey, snapID, chain, filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// rebuild replays the records of path across chain into an unlinked
+// temporary file, which is returned positioned at its start.
+func rebuild(ctx context.Context, secretKey *stream.SecretKey, snapID snapshotID, chain IncrementalFiles, path string) (*os.File, error) {
+	var cur *os.File
+	var md *archive.Metadata
+	fail := func(err error) (*os.File, error) {
+		if cur != nil {
+			cur.Close()
+		}
+		return nil, err
+	}
+
+	for i, inst := range chain {
+		if ctx.Err() != nil {
+			return fail(ctx.Err())
+		}
+		r, err := openIncrement(inst, snapID, secretKey)
+		if err != nil {
+			return fail(err)
+		}
+		rec, err := findRecord(r, path)
+		if err != nil {
+			r.Close()
+			return fail(err)
+		}
+		if rec == nil {
+			if err = r.Close(); err != nil {
+				return fail(err)
+			}
+			continue
+		}
+
+		md = &rec.Metadata
+		fileMode := os.FileMode(md.Attribs.Mode)
+		var next *os.File
+		switch {
+		case rec.Kind == archive.KindDelete:
+			md = nil
+		case isSymlink(fileMode) || fileMode.IsRegular():
+			if target, ok := md.Link(); ok {
+				// The contents are those of the link target
+				// as of this increment.
+				next, err = rebuild(ctx, secretKey, snapID,
+					chain[:i+1], target)
+			} else {
+				next, err = replayRecord(r, rec, cur)
+			}
+			if err != nil {
+				r.Close()
+				return fail(err)
+			}
+		}
+		if cur != nil {
+			cur.Close()
+		}
+		cur = next
+		if err = r.Close(); err != nil {
+			return fail(err)
+		}
+	}
+
+	if md == nil {
+		return fail(fmt.Errorf("%q: not found", path))
+	}
+	if cur == nil {
+		return fail(fmt.Errorf("%q: not a regular file or symlink: %v",
+			path, os.FileMode(md.Attribs.Mode)))
+	}
+	if _, err := cur.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return cur, nil
+}
+
+// replayRecord applies rec to the contents in basis, which may be nil, and
+// returns the result in a new unlinked temporary file.
+func replayRecord(r *archive.Reader, rec *archive.Record, basis *os.File) (*os.File, error) {
+	f, err := os.CreateTemp("", "multus-get")
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	delta := rec.Kind == archive.KindChange
+	if r.Header.Version < archive.Version2 {
+		delta = basis != nil
+	}
+	extents, sparse, err := rec.Metadata.Extents()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	switch {
+	case delta:
+		var b io.ReadSeeker = strings.NewReader("")
+		if basis != nil {
+			if _, err = basis.Seek(0, io.SeekStart); err != nil {
+				f.Close()
+				return nil, err
+			}
+			b = basis
+		}
+		err = rsync.Patch(rec.Data, b, f)
+	case sparse:
+		err = writeExtents(f, rec.Data, extents, rec.Metadata.Attribs.Size)
+	default:
+		_, err = io.CopyN(f, rec.Data, rec.DataLen)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// findRecord returns the record of path in r or nil when r has none.
+func findRecord(r *archive.Reader, path string) (*archive.Record, error) {
+	index, err := r.Index()
+	if err != nil {
+		return nil, err
+	}
+	if index != nil {
+		for _, e := range index {
+			if e.Path != path {
+				continue
+			}
+			if err = r.Seek(e); err != nil {
+				return nil, err
+			}
+			return r.Next()
+		}
+		return nil, nil
+	}
+	for {
+		rec, err := r.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if rec.Metadata.Path == path {
+			return rec, nil
+		}
+	}
+}
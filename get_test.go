@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	tb := newTestBackup(t)
+	level0 := bytes.Repeat([]byte("level 0\n"), 8192)
+	tb.write("file", level0, 0o644)
+	if err := os.Symlink("file", tb.path("symlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(tb.path("file"), tb.path("link")); err != nil {
+		t.Fatal(err)
+	}
+	tb.backup()
+	level1 := append([]byte(nil), level0...)
+	copy(level1[4096:], "level 1")
+	tb.write("file", level1, 0o644)
+	tb.backup()
+
+	tests := []struct {
+		name  string
+		level int32
+		path  string
+		want  []byte
+	}{
+		{"file", 0, "file", level0},
+		{"patched file", 1, "file", level1},
+		{"symlink", 1, "symlink", []byte("file")},
+		{"hard link", 0, "link", level0},
+		{"patched hard link", 1, "link", level1},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		err := get(context.Background(), tb.secretKey, tb.cfg.BackupPath,
+			test.level, snapshotOptions{}, tb.path(test.path), &out)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(out.Bytes(), test.want) {
+			t.Errorf("%s: got %d bytes, want %d", test.name, out.Len(),
+				len(test.want))
+		}
+	}
+
+	for path, want := range map[string]string{
+		tb.path("missing"): "not found",
+		tb.src:             "not a regular file",
+	} {
+		err := get(context.Background(), tb.secretKey, tb.cfg.BackupPath,
+			-1, snapshotOptions{}, path, new(bytes.Buffer))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want %q", path, err, want)
+		}
+	}
+}
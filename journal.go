@@ -0,0 +1,540 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"multus/archive"
+)
+
+// journalName is the file in the root of the destination recording the
+// progress of a restore.
+const journalName = ".multus-restore.journal"
+
+// journalSyncRecords is the number of completed records after which the
+// journal is synced, which bounds the work a crash loses.
+const journalSyncRecords = 256
+
+// journalKey identifies a record by its level and its position in the
+// increment.
+type journalKey struct {
+	level uint16
+	index int
+}
+
+// pathState is what a record left its path as.
+type pathState int
+
+const (
+	// pathAbsent is a deleted path, or one that could not be created.
+	pathAbsent pathState = iota
+
+	// pathWritten is a path written by the restore.
+	pathWritten
+
+	// pathSkipped is an existing path left alone by conflictSkip.
+	pathSkipped
+)
+
+// journalEntry is the outcome of a completed record.
+type journalEntry struct {
+	path  string
+	state pathState
+	file  fileState
+
+	// target is the backed up target of a symlink restored with a
+	// rewritten target.
+	target string
+}
+
+// journal records the progress of a restore in its destination.  It is
+// made of lines appended as the restore goes: the snapshot and level
+// restored along with a digest of the options selecting its records, then
+// every record begun and completed, along with the state it left its path
+// in, and every level completed.  Each line is written at once, so a killed
+// restore leaves at most a partial last line, which is ignored.
+//
+// A record that was begun but not completed may have been partially
+// applied.  Deltas keep the basis they patch linked to <path>.basis until
+// their completion is synced to the journal, so that resuming can roll them
+// back before applying them again.
+type journal struct {
+	mu   sync.Mutex
+	f    *os.File
+	path string
+
+	snapID   snapshotID
+	level    int32
+	settings string
+
+	// unsynced counts the records completed since the last sync and
+	// bases holds the paths whose basis is removed once they are.
+	unsynced int
+	bases    []string
+
+	// The records begun and completed, and the levels completed, by the
+	// restore being resumed.
+	begun  map[journalKey]string
+	done   map[journalKey]journalEntry
+	order  []journalKey
+	levels map[uint16]struct{}
+}
+
+// createJournal starts the journal of a restore of snapID up to level with
+// settings, see journalSettings.  An existing journal is an interrupted
+// restore that must be resumed.
+func createJournal(destDir string, snapID snapshotID, level int32, settings string) (*journal, error) {
+	if err := os.MkdirAll(destDir, 0o0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(destDir, journalName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|
+		os.O_APPEND|syscall.O_NOFOLLOW, 0o0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("%q: a restore was interrupted, "+
+				"continue it with --resume", path)
+		}
+		return nil, err
+	}
+	j := &journal{
+		f:        f,
+		path:     path,
+		snapID:   snapID,
+		level:    level,
+		settings: settings,
+	}
+	err = j.write(fmt.Sprintf("snapshot %q %d %d %s\n", snapID.Hostname,
+		snapID.Timestamp.Unix(), level, settings))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// openJournal loads the journal of an interrupted restore to destDir and
+// opens it to carry on.
+func openJournal(destDir string) (*journal, error) {
+	path := filepath.Join(destDir, journalName)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%q: no interrupted restore to "+
+				"resume", path)
+		}
+		return nil, err
+	}
+	j := &journal{
+		path:   path,
+		begun:  make(map[journalKey]string),
+		done:   make(map[journalKey]journalEntry),
+		levels: make(map[uint16]struct{}),
+	}
+	lines := strings.Split(string(b), "\n")
+	// The last line is either empty or was cut short.
+	for n, line := range lines[:len(lines)-1] {
+		if err = j.parse(line, n == 0); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n+1, err)
+		}
+	}
+	if j.snapID.Hostname == "" {
+		return nil, fmt.Errorf("%q: no snapshot", path)
+	}
+	j.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|
+		syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Drop the partial last line before carrying on.
+	if err = j.f.Truncate(int64(len(b) - len(lines[len(lines)-1]))); err != nil {
+		j.f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *journal) parse(line string, first bool) error {
+	fields, err := splitQuoted(line)
+	if err != nil {
+		return err
+	}
+	invalid := fmt.Errorf("invalid line %q", line)
+	if len(fields) == 0 || first != (fields[0] == "snapshot") {
+		return invalid
+	}
+	nums := func(fields []string) ([]int64, error) {
+		ns := make([]int64, len(fields))
+		for i, f := range fields {
+			n, err := strconv.ParseInt(f, 10, 64)
+			if err != nil {
+				return nil, invalid
+			}
+			ns[i] = n
+		}
+		return ns, nil
+	}
+	switch {
+	case fields[0] == "snapshot" && len(fields) == 5:
+		ns, err := nums(fields[2:4])
+		if err != nil {
+			return err
+		}
+		j.snapID = snapshotID{
+			Hostname:  fields[1],
+			Timestamp: time.Unix(ns[0], 0),
+		}
+		j.level = int32(ns[1])
+		j.settings = fields[4]
+	case fields[0] == "begin" && len(fields) == 4:
+		ns, err := nums(fields[1:3])
+		if err != nil {
+			return err
+		}
+		j.begun[journalKey{level: uint16(ns[0]), index: int(ns[1])}] = fields[3]
+	case fields[0] == "done" && len(fields) == 9:
+		ns, err := nums([]string{fields[1], fields[2], fields[4],
+			fields[5], fields[6], fields[7]})
+		if err != nil {
+			return err
+		}
+		key := journalKey{level: uint16(ns[0]), index: int(ns[1])}
+		j.done[key] = journalEntry{
+			path:  fields[3],
+			state: pathState(ns[2]),
+			file: fileState{
+				size: ns[3],
+				mtim: ns[4],
+				ino:  uint64(ns[5]),
+			},
+			target: fields[8],
+		}
+		j.order = append(j.order, key)
+	case fields[0] == "level" && len(fields) == 2:
+		ns, err := nums(fields[1:])
+		if err != nil {
+			return err
+		}
+		j.levels[uint16(ns[0])] = struct{}{}
+	default:
+		return invalid
+	}
+	return nil
+}
+
+// splitQuoted splits a journal line into words and Go quoted strings.
+func splitQuoted(line string) ([]string, error) {
+	var fields []string
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		switch {
+		case line == "":
+		case line[0] == '"':
+			q, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, err
+			}
+			s, err := strconv.Unquote(q)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, s)
+			line = line[len(q):]
+		default:
+			i := strings.IndexByte(line, ' ')
+			if i < 0 {
+				i = len(line)
+			}
+			fields = append(fields, line[:i])
+			line = line[i:]
+		}
+	}
+	return fields, nil
+}
+
+// journalSettings returns a digest of the options deciding which records
+// of an increment a restore applies, how they are numbered and what they do
+// to the destination.  A restore is only resumed with the same settings.
+func journalSettings(paths *pathRewriter, policy conflictPolicy) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "strip-prefix %q\n", paths.stripPrefix)
+	for _, m := range paths.maps {
+		fmt.Fprintf(h, "map %q %q\n", m.old, m.new)
+	}
+	fmt.Fprintf(h, "rewrite-symlinks %v\n", paths.symlinks)
+	fmt.Fprintf(h, "conflict %v\n", policy)
+	// Selective restores of indexed increments number the records by
+	// their index entry.
+	fmt.Fprintf(h, "indexed %v\n", paths.selective())
+	if f := paths.filter; f != nil {
+		for _, re := range f.include {
+			fmt.Fprintf(h, "include %q\n", re.String())
+		}
+		for _, re := range f.exclude {
+			fmt.Fprintf(h, "exclude %q\n", re.String())
+		}
+		files := make([]string, 0, len(f.files))
+		for path := range f.files {
+			files = append(files, path)
+		}
+		sort.Strings(files)
+		for _, path := range files {
+			fmt.Fprintf(h, "file %q\n", path)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (j *journal) write(line string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err := j.f.WriteString(line)
+	return err
+}
+
+// completed reports whether the record was completed before the restore was
+// resumed.
+func (j *journal) completed(key journalKey) bool {
+	if j == nil {
+		return false
+	}
+	_, ok := j.done[key]
+	return ok
+}
+
+// begin records that the record of the rewritten archive path is about to
+// be applied.
+func (j *journal) begin(key journalKey, path string) error {
+	return j.write(fmt.Sprintf("begin %d %d %q\n", key.level, key.index,
+		path))
+}
+
+// finish records the outcome of a record.  The journal is synced every
+// journalSyncRecords records, after which the basis kept for them is no
+// longer needed: the paths whose basis can be removed are returned.  The
+// basis of the rewritten archive path is kept until then when keep is set.
+func (j *journal) finish(key journalKey, e journalEntry, keep bool) ([]string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err := j.f.WriteString(fmt.Sprintf("done %d %d %q %d %d %d %d %q\n",
+		key.level, key.index, e.path, e.state, e.file.size, e.file.mtim,
+		e.file.ino, e.target))
+	if err != nil {
+		return nil, err
+	}
+	if keep {
+		j.bases = append(j.bases, e.path)
+	}
+	if j.unsynced++; j.unsynced < journalSyncRecords {
+		return nil, nil
+	}
+	return j.syncLocked()
+}
+
+// sync syncs the completed records and returns the paths whose basis can
+// be removed.
+func (j *journal) sync() ([]string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.syncLocked()
+}
+
+func (j *journal) syncLocked() ([]string, error) {
+	if err := j.f.Sync(); err != nil {
+		return nil, err
+	}
+	bases := j.bases
+	j.unsynced = 0
+	j.bases = nil
+	return bases, nil
+}
+
+// endLevel records that every record of level was applied.  The bases kept
+// must have been removed first, since a later level would otherwise take
+// them for those of interrupted records.
+func (j *journal) endLevel(level uint16) error {
+	if err := j.write(fmt.Sprintf("level %d\n", level)); err != nil {
+		return err
+	}
+	_, err := j.sync()
+	return err
+}
+
+func (j *journal) Close() error {
+	return j.f.Close()
+}
+
+// remove deletes the journal of a completed restore.
+func (j *journal) remove() error {
+	if err := j.f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(j.path)
+}
+
+// resume restores the state of the restore recorded by j and rolls back the
+// records it interrupted.
+func (rs *restorer) resume(j *journal) error {
+	for _, key := range j.order {
+		e := j.done[key]
+		path := filepath.Join(rs.dest.root, e.path)
+		delete(rs.written, path)
+		delete(rs.skipped, path)
+		delete(rs.targets, path)
+		switch e.state {
+		case pathWritten:
+			rs.written[path] = e.file
+		case pathSkipped:
+			rs.skipped[path] = struct{}{}
+		}
+		if e.target != "" {
+			rs.targets[path] = e.target
+		}
+	}
+
+	var interrupted []journalKey
+	rollback := make(map[string]struct{})
+	for key, path := range j.begun {
+		if _, ok := j.done[key]; !ok {
+			interrupted = append(interrupted, key)
+			rollback[path] = struct{}{}
+		}
+	}
+	for key, path := range j.begun {
+		_, done := j.done[key]
+		_, ended := j.levels[key.level]
+		_, interrupted := rollback[path]
+		if done && !ended && !interrupted {
+			// The restore may have stopped before the basis
+			// was removed.
+			rs.removeBasis(path)
+		}
+	}
+	for level := uint16(0); level <= uint16(j.level); level++ {
+		if _, ok := j.levels[level]; !ok {
+			log.Printf("level %d was partially applied: %d records "+
+				"interrupted", level, countLevel(interrupted, level))
+			break
+		}
+	}
+	for _, key := range interrupted {
+		path := j.begun[key]
+		if err := rs.rollback(path); err != nil {
+			return err
+		}
+		full := filepath.Join(rs.dest.root, path)
+		if _, ok := rs.written[full]; !ok {
+			// The record may have created the path, which is
+			// not a conflict when it is applied again.
+			rs.written[full] = fileState{}
+		}
+	}
+	rs.journal = j
+	return nil
+}
+
+func countLevel(keys []journalKey, level uint16) int {
+	n := 0
+	for _, key := range keys {
+		if key.level == level {
+			n++
+		}
+	}
+	return n
+}
+
+// rollback puts back the basis of an interrupted record of the rewritten
+// archive path and removes its partial file.
+func (rs *restorer) rollback(path string) error {
+	p, err := rs.dest.open(path, false)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer p.Close()
+	unix.Unlinkat(p.dir, p.name+".partial", 0)
+	err = p.rename(".basis")
+	switch {
+	case err == nil:
+		log.Printf("%q: rolled back to its basis", p.path)
+	case errors.Is(err, unix.ENOENT):
+		err = nil
+	}
+	return err
+}
+
+// keepBasis links the basis of a delta applied to p to p.basis while the
+// restore is journaled.
+func (rs *restorer) keepBasis(p *destPath) error {
+	if rs.journal == nil {
+		return nil
+	}
+	unix.Unlinkat(p.dir, p.name+".basis", 0)
+	err := unix.Linkat(p.dir, p.name, p.dir, p.name+".basis", 0)
+	return p.pathError("link", err)
+}
+
+// removeBasis removes the basis kept for a delta applied to the rewritten
+// archive path.
+func (rs *restorer) removeBasis(path string) {
+	p, err := rs.dest.open(path, false)
+	if err != nil {
+		return
+	}
+	unix.Unlinkat(p.dir, p.name+".basis", 0)
+	p.Close()
+}
+
+// outcome returns the journal entry of the rewritten archive path once its
+// record has been applied.
+func (rs *restorer) outcome(path string) journalEntry {
+	full := filepath.Join(rs.dest.root, path)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	e := journalEntry{path: path, target: rs.targets[full]}
+	if st, ok := rs.written[full]; ok {
+		e.state = pathWritten
+		e.file = st
+	} else if _, ok := rs.skipped[full]; ok {
+		e.state = pathSkipped
+	}
+	return e
+}
+
+// replay applies the deferred metadata of a record completed before the
+// restore was resumed.
+func (rs *restorer) replay(rec *archive.Record, path string) error {
+	rs.mu.Lock()
+	_, skipped := rs.skipped[filepath.Join(rs.dest.root, path)]
+	rs.mu.Unlock()
+	if skipped {
+		return nil
+	}
+	rs.pending.remove(path)
+	if rec.Kind == archive.KindDelete {
+		return nil
+	}
+	flags, err := rec.Metadata.Flags()
+	if err != nil {
+		return err
+	}
+	rs.pending.setFlags(path, flags)
+	if isDir(os.FileMode(rec.Metadata.Attribs.Mode)) {
+		rs.pending.setDir(path, rec.Metadata.Attribs)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournalSettings(t *testing.T) {
+	filter := func(includes ...string) *pathFilter {
+		f := new(pathFilter)
+		for _, s := range includes {
+			if err := f.addInclude(s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return f
+	}
+	tests := []struct {
+		name   string
+		paths  *pathRewriter
+		policy conflictPolicy
+	}{
+		{"default", &pathRewriter{}, conflictOverwrite},
+		{"strip-prefix", &pathRewriter{stripPrefix: "/home"}, conflictOverwrite},
+		{"map", &pathRewriter{maps: []pathMapping{{old: "/a", new: "/b"}}}, conflictOverwrite},
+		{"rewrite-symlinks", &pathRewriter{symlinks: true}, conflictOverwrite},
+		{"conflict", &pathRewriter{}, conflictSkip},
+		{"include", &pathRewriter{filter: filter("*.go")}, conflictOverwrite},
+		{"other include", &pathRewriter{filter: filter("*.c")}, conflictOverwrite},
+	}
+	seen := make(map[string]string)
+	for _, tt := range tests {
+		s := journalSettings(tt.paths, tt.policy)
+		if s != journalSettings(tt.paths, tt.policy) {
+			t.Errorf("%s: settings differ between calls", tt.name)
+		}
+		if name, ok := seen[s]; ok {
+			t.Errorf("%s: same settings as %s", tt.name, name)
+		}
+		seen[s] = tt.name
+	}
+}
+
+func TestJournalReopen(t *testing.T) {
+	dir := t.TempDir()
+	snapID := snapshotID{Hostname: "host name", Timestamp: time.Unix(1700000000, 0)}
+	j, err := createJournal(dir, snapID, 2, "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = createJournal(dir, snapID, 2, "settings"); err == nil {
+		t.Fatal("journal created over an interrupted restore")
+	}
+
+	key := journalKey{level: 1, index: 7}
+	if err = j.begin(key, "/a b"); err != nil {
+		t.Fatal(err)
+	}
+	if err = j.begin(journalKey{level: 1, index: 8}, "/c"); err != nil {
+		t.Fatal(err)
+	}
+	e := journalEntry{
+		path:   "/a b",
+		state:  pathWritten,
+		file:   fileState{size: 10, mtim: 20, ino: 30},
+		target: "/t",
+	}
+	if _, err = j.finish(key, e, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = j.endLevel(0); err != nil {
+		t.Fatal(err)
+	}
+	// A line cut short by a crash.
+	if err = j.write("done 1 8 \"/c"); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	j, err = openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if !j.snapID.Timestamp.Equal(snapID.Timestamp) || j.snapID.Hostname != snapID.Hostname ||
+		j.level != 2 || j.settings != "settings" {
+		t.Errorf("reopened %v level %d settings %q", j.snapID, j.level, j.settings)
+	}
+	if len(j.begun) != 2 || j.begun[key] != "/a b" {
+		t.Errorf("begun %v", j.begun)
+	}
+	if len(j.done) != 1 || j.done[key] != e {
+		t.Errorf("done %v", j.done)
+	}
+	if _, ok := j.levels[0]; !ok || len(j.levels) != 1 {
+		t.Errorf("levels %v", j.levels)
+	}
+	b, err := os.ReadFile(j.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(b, []byte("level 0\n")) {
+		t.Errorf("partial line kept: %q", b)
+	}
+}
+
+func TestJournalSync(t *testing.T) {
+	j, err := createJournal(t.TempDir(), snapshotID{Hostname: "h"}, 0, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	var removed []string
+	for i := 0; i < journalSyncRecords+1; i++ {
+		path := fmt.Sprintf("/f%d", i)
+		bases, err := j.finish(journalKey{index: i}, journalEntry{path: path}, i%2 == 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bases) != 0 && i != journalSyncRecords-1 {
+			t.Fatalf("bases returned after record %d", i)
+		}
+		removed = append(removed, bases...)
+	}
+	if len(removed) != journalSyncRecords/2 {
+		t.Fatalf("%d bases returned after a sync, want %d", len(removed),
+			journalSyncRecords/2)
+	}
+	bases, err := j.sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bases) != 1 || bases[0] != fmt.Sprintf("/f%d", journalSyncRecords) {
+		t.Fatalf("bases %v", bases)
+	}
+}
+
+func TestResume(t *testing.T) {
+	tb := newTestBackup(t)
+	for i := 0; i < 100; i++ {
+		tb.write(fmt.Sprintf("d%d/f%d", i%5, i), bytes.Repeat([]byte{byte(i)}, 5000+i), 0o644)
+	}
+	tb.backup()
+	for i := 0; i < 100; i += 2 {
+		f, err := os.OpenFile(tb.path(fmt.Sprintf("d%d/f%d", i%5, i)), os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte("changed"), 100)
+		f.Close()
+	}
+	tb.backup()
+
+	for _, n := range []int{10, 150} {
+		dest := filepath.Join(t.TempDir(), "dest")
+		journal := filepath.Join(dest, journalName)
+		// Cancel the restore once n lines were journaled.
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			for ctx.Err() == nil {
+				b, _ := os.ReadFile(journal)
+				if bytes.Count(b, []byte("\n")) >= n {
+					cancel()
+				}
+				time.Sleep(50 * time.Microsecond)
+			}
+		}()
+		err := restore(ctx, tb.secretKey, tb.cfg.BackupPath, dest, nil, -1,
+			restoreOptions{jobs: 2})
+		cancel()
+		if err == nil {
+			t.Logf("restore completed before %d lines were journaled", n)
+			tb.diff(dest)
+			continue
+		}
+
+		err = restore(context.Background(), tb.secretKey, tb.cfg.BackupPath,
+			dest, nil, -1, restoreOptions{})
+		if err == nil || !strings.Contains(err.Error(), "--resume") {
+			t.Fatalf("restore over an interrupted one: %v", err)
+		}
+		err = restore(context.Background(), tb.secretKey, tb.cfg.BackupPath,
+			dest, nil, -1, restoreOptions{resume: true, stripPrefix: tb.src})
+		if err == nil || !strings.Contains(err.Error(), "same ones") {
+			t.Fatalf("resume with other options: %v", err)
+		}
+		err = restore(context.Background(), tb.secretKey, tb.cfg.BackupPath,
+			dest, nil, -1, restoreOptions{resume: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(journal); !os.IsNotExist(err) {
+			t.Fatalf("journal left behind: %v", err)
+		}
+		left, _ := filepath.Glob(filepath.Join(dest, tb.src, "*", "*.basis"))
+		if len(left) != 0 {
+			t.Fatalf("bases left behind: %v", left)
+		}
+		tb.diff(dest)
+	}
+}
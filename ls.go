@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jrick/ss/stream"
+	"github.com/smtc/rsync"
+	"golang.org/x/sys/unix"
+	"multus/archive"
+)
+
+// lsOptions holds the ls command line options.
+type lsOptions struct {
+	snapshotOptions
+
+	// long prints the mode, owner, size and mtime of each entry.
+	long bool
+
+	// recursive lists the contents of directories recursively.
+	recursive bool
+}
+
+// lsEntry is the state of a path after replaying a chain of increments.
+type lsEntry struct {
+	md     archive.Metadata
+	target string
+}
+
+// ls replays the metadata of a snapshot up to level and lists paths.  The
+// backed up roots are listed when no path is given.
+func ls(ctx context.Context, secretKey *stream.SecretKey, sourceDir string, level int32, opts lsOptions, paths []string) error {
+	snapID, chain, err := selectChain(ctx, secretKey, sourceDir, level,
+		opts.snapshotOptions)
+	if err != nil {
+		return err
+	}
+
+	for i := range paths {
+		paths[i] = filepath.Clean(paths[i])
+	}
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	match := func(path string) bool {
+		for _, p := range paths {
+			if path == p || isUnder(path, p) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, p := range paths {
+		if p == "/" {
+			// Every record is listed, read them in order.
+			match = nil
+		}
+	}
+
+	tree := make(map[string]*lsEntry)
+	for _, inst := range chain {
+		r, err := openIncrement(inst, snapID, secretKey)
+		if err != nil {
+			return err
+		}
+		if err = lsReplay(ctx, r, tree, match); err != nil {
+			r.Close()
+			return err
+		}
+		if err = r.Close(); err != nil {
+			return err
+		}
+	}
+
+	sorted := make([]string, 0, len(tree))
+	for path := range tree {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	var missing []string
+	for _, p := range paths {
+		if e, ok := tree[p]; ok && !isDir(os.FileMode(e.md.Attribs.Mode)) {
+			lsPrint(e, opts.long)
+			continue
+		}
+		found := false
+		for _, path := range sorted {
+			if !isUnder(path, p) {
+				continue
+			}
+			found = true
+			// Entries whose parent was not backed up are listed
+			// along with the children of p.
+			parent := filepath.Dir(path)
+			if _, ok := tree[parent]; ok && parent != p && !opts.recursive {
+				continue
+			}
+			lsPrint(tree[path], opts.long)
+		}
+		if _, ok := tree[p]; !ok && !found {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("not found: %q", missing)
+	}
+	return nil
+}
+
+// lsReplay applies the records of r matching match to tree, or every record
+// when match is nil.  The index is only used to narrow the records down.
+func lsReplay(ctx context.Context, r *archive.Reader, tree map[string]*lsEntry, match func(string) bool) error {
+	var index []archive.IndexEntry
+	if match != nil {
+		var err error
+		if index, err = r.Index(); err != nil {
+			return err
+		}
+	} else {
+		match = func(string) bool { return true }
+	}
+	next := r.Next
+	if index != nil {
+		// Only decode the blocks holding matching records, reading
+		// on without seeking while they follow each other.
+		i, pos := 0, 0
+		next = func() (*archive.Record, error) {
+			for ; i < len(index); i++ {
+				e := index[i]
+				if !match(e.Path) {
+					continue
+				}
+				if i != pos {
+					if err := r.Seek(e); err != nil {
+						return nil, err
+					}
+				}
+				i++
+				pos = i
+				return r.Next()
+			}
+			return nil, io.EOF
+		}
+	}
+
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rec, err := next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		path := rec.Metadata.Path
+		if !match(path) {
+			continue
+		}
+		if rec.Kind == archive.KindDelete {
+			delete(tree, path)
+			continue
+		}
+
+		e := &lsEntry{md: rec.Metadata}
+		if isSymlink(os.FileMode(rec.Metadata.Attribs.Mode)) {
+			prev := tree[path]
+			delta := rec.Kind == archive.KindChange
+			if r.Header.Version < archive.Version2 {
+				delta = prev != nil
+			}
+			e.target, err = lsTarget(rec, prev, delta)
+			if err != nil {
+				return err
+			}
+		}
+		tree[path] = e
+	}
+}
+
+// lsTarget returns the target of a symlink record.
+func lsTarget(rec *archive.Record, prev *lsEntry, delta bool) (string, error) {
+	b := new(bytes.Buffer)
+	if _, err := io.CopyN(b, rec.Data, rec.DataLen); err != nil {
+		return "", err
+	}
+	if !delta {
+		return b.String(), nil
+	}
+	var basis string
+	if prev != nil {
+		basis = prev.target
+	}
+	target := new(bytes.Buffer)
+	err := rsync.Patch(bytes.NewReader(b.Bytes()), strings.NewReader(basis), target)
+	if err != nil {
+		// The delta is against the contents of what used to be a
+		// file.
+		return "?", nil
+	}
+	return target.String(), nil
+}
+
+func lsPrint(e *lsEntry, long bool) {
+	md := &e.md
+	if !long {
+		fmt.Println(md.Path)
+		return
+	}
+
+	fileMode := os.FileMode(md.Attribs.Mode)
+	size := fmt.Sprintf("%d", md.Attribs.Size)
+	if isDevice(fileMode) {
+		size = fmt.Sprintf("%d, %d", unix.Major(md.Attribs.RDev),
+			unix.Minor(md.Attribs.RDev))
+	}
+	mtime := time.Unix(0, md.Attribs.MTim).Format("2006-01-02 15:04")
+	fmt.Printf("%v %5d %5d %10s %s %s", fileMode, md.Attribs.UID,
+		md.Attribs.GID, size, mtime, md.Path)
+	if isSymlink(fileMode) {
+		fmt.Printf(" -> %s", e.target)
+	} else if target, ok := md.Link(); ok {
+		fmt.Printf(" link to %s", target)
+	}
+	fmt.Println()
+}
+
+// isUnder reports whether path is below the directory dir.
+func isUnder(path, dir string) bool {
+	if dir == "/" {
+		return path != "/" && strings.HasPrefix(path, "/")
+	}
+	return strings.HasPrefix(path, dir+"/")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLs(t *testing.T) {
+	tb := newTestBackup(t)
+	tb.write("d/a", []byte("a\n"), 0o644)
+	tb.write("d/sub/b", []byte("b\n"), 0o600)
+	if err := os.Symlink("d/a", tb.path("l")); err != nil {
+		t.Fatal(err)
+	}
+	tb.backup()
+	if err := os.Remove(tb.path("d/sub/b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(tb.path("l")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("d/sub", tb.path("l")); err != nil {
+		t.Fatal(err)
+	}
+	tb.write("c", []byte("c\n"), 0o644)
+	tb.backup()
+
+	lines := func(names ...string) []string {
+		for i := range names {
+			names[i] = tb.path(names[i])
+		}
+		return names
+	}
+	tests := []struct {
+		name  string
+		level int32
+		opts  lsOptions
+		paths []string
+		want  []string
+	}{
+		{"level 0", 0, lsOptions{}, lines(""), lines("d", "l")},
+		{"level 0 recursive", 0, lsOptions{recursive: true}, lines("d"),
+			lines("d/a", "d/sub", "d/sub/b")},
+		{"latest", -1, lsOptions{}, lines(""), lines("c", "d", "l")},
+		{"latest recursive", -1, lsOptions{recursive: true}, lines("d"),
+			lines("d/a", "d/sub")},
+		{"file", 0, lsOptions{}, lines("d/sub/b"), lines("d/sub/b")},
+		{"long", 0, lsOptions{long: true}, lines("d/sub/b"),
+			[]string{"-rw-------", tb.path("d/sub/b")}},
+		{"long symlink", 0, lsOptions{long: true}, lines("l"),
+			[]string{"L", tb.path("l") + " -> d/a"}},
+		{"long symlink patched", 1, lsOptions{long: true}, lines("l"),
+			[]string{"L", tb.path("l") + " -> d/sub"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := stdout(t, func() error {
+				return ls(context.Background(), tb.secretKey,
+					tb.cfg.BackupPath, test.level, test.opts,
+					test.paths)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+			if !test.opts.long {
+				if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+					t.Errorf("got %q, want %q", got, test.want)
+				}
+				return
+			}
+			// The mode leads and the path ends long lines.
+			if len(got) != 1 || !strings.HasPrefix(got[0], test.want[0]) ||
+				!strings.HasSuffix(got[0], test.want[1]) {
+				t.Errorf("got %q, want %q ... %q", got, test.want[0],
+					test.want[1])
+			}
+		})
+	}
+
+	_, err := stdout(t, func() error {
+		return ls(context.Background(), tb.secretKey, tb.cfg.BackupPath,
+			-1, lsOptions{}, []string{tb.path("d/sub/b")})
+	})
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("deleted path: got %v, want not found", err)
+	}
+}
@@ -3,23 +3,31 @@ package main
 import (
 	"bytes"
 	"context"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"log/syslog"
+	"math"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jrick/ss/keyfile"
+	"github.com/jrick/ss/stream"
 	"golang.org/x/term"
+	"multus/archive"
 )
 
-const FormatVersion = uint16(1)
+// FormatVersion is recorded in the signature cache.  Its layout is the same
+// for every snapshot format version.
+const FormatVersion = archive.Version
 
 var (
 	syslogDebug bool
@@ -27,7 +35,118 @@ var (
 )
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "backup\nrestore /RESTOREPATH [file] [level]\ncat <inc-file>")
+	fmt.Fprintln(os.Stderr, "backup\n"+
+		"restore [--snapshot <timestamp|latest|id>] [--host <name>] [--at <time>] [--dry-run]\n"+
+		"        [--overwrite|--skip-existing|--rename-existing|--fail-on-conflict]\n"+
+		"        [--strip-prefix <dir>] [--map <old>=<new> ...] [--rewrite-symlinks]\n"+
+		"        [--include <pattern> ...] [--exclude <pattern> ...] [--files-from <file>] [--jobs N]\n"+
+		"        [--resume] [--verify] /RESTOREPATH [file] [level]\n"+
+		"restore --format tar [-o <file>] [--snapshot <timestamp|latest|id>] [--host <name>] [--at <time>]\n"+
+		"        [--strip-prefix <dir>] [--map <old>=<new> ...]\n"+
+		"        [--include <pattern> ...] [--exclude <pattern> ...] [--files-from <file>] [file] [level]\n"+
+		"verify-restore [--snapshot <timestamp|latest|id>] [--host <name>] [--at <time>]\n"+
+		"        [--strip-prefix <dir>] [--map <old>=<new> ...] [--rewrite-symlinks]\n"+
+		"        [--include <pattern> ...] [--exclude <pattern> ...] [--files-from <file>]\n"+
+		"        /RESTOREPATH [file] [level]\n"+
+		"cat [--include <pattern> ...] [--exclude <pattern> ...] [--files-from <file>] <inc-file> [file]\n"+
+		"ls [--snapshot <timestamp|latest|id>] [--host <name>] [--at <time>] [--level N] [-l] [-R] [path ...]\n"+
+		"get [--snapshot <timestamp|latest|id>] [--host <name>] [--at <time>] [--level N] <path>\n"+
+		"mount [--host <name>] <mountpoint>")
+}
+
+// snapshotFlags adds the flags selecting a snapshot to fs.
+func snapshotFlags(fs *flag.FlagSet, opts *snapshotOptions) {
+	fs.StringVar(&opts.snapshot, "snapshot", "",
+		"snapshot: an RFC3339 timestamp, latest or an id")
+	fs.StringVar(&opts.host, "host", "",
+		"only consider the snapshots of host")
+	fs.Func("at", "the state as of an RFC3339 time", func(s string) error {
+		at, err := time.Parse(time.RFC3339, s)
+		opts.at = at
+		return err
+	})
+}
+
+// pathFlags adds the flags rewriting and selecting restored paths to fs.
+func pathFlags(fs *flag.FlagSet, opts *restoreOptions, filter *pathFilter) {
+	filterFlags(fs, filter)
+	fs.Func("strip-prefix", "restore the paths below dir to the "+
+		"destination root", func(s string) error {
+		dir, err := absPath(s)
+		opts.stripPrefix = dir
+		return err
+	})
+	fs.Func("map", "restore the paths below old to new instead "+
+		"(repeatable)", func(s string) error {
+		m, err := parsePathMapping(s)
+		opts.maps = append(opts.maps, m)
+		return err
+	})
+	fs.BoolVar(&opts.rewriteSymlinks, "rewrite-symlinks", false,
+		"point absolute symlinks into the destination like the paths")
+}
+
+// restoreArgs parses the destination, when dest is set, file and level
+// arguments of restore and exits on failure.  The level is -1 when not
+// given.
+func restoreArgs(fs *flag.FlagSet, filter *pathFilter, dest bool) (string, int32) {
+	args := fs.Args()
+	var destDir string
+	if dest {
+		if len(args) < 1 {
+			usage()
+			os.Exit(1)
+		}
+		destDir = filepath.Clean(args[0])
+		args = args[1:]
+	}
+
+	if len(args) > 0 {
+		if err := filter.addRegexp(args[0]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	level := int32(-1)
+	if len(args) > 1 {
+		i, err := strconv.ParseUint(args[1], 10, 16)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		level = int32(i)
+	}
+	return destDir, level
+}
+
+// openSecretKey prompts for the passphrase of the configured secret key and
+// exits on failure.
+func openSecretKey(cfg *config) *stream.SecretKey {
+	if len(cfg.Restore.SecretFile) == 0 {
+		fmt.Fprintln(os.Stderr, "secretfile not set")
+		os.Exit(1)
+	}
+	skBytes, err := ioutil.ReadFile(cfg.Restore.SecretFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "%q secret: ", cfg.Restore.SecretFile)
+	secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprint(os.Stderr, "\n")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	sk, _, err := keyfile.OpenSecretKey(bytes.NewReader(skBytes), secret)
+	zero(secret)
+	zero(skBytes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return sk
 }
 
 func main() {
@@ -114,85 +233,156 @@ func main() {
 		}
 		gErr = backup(ctx, pubKey, cfg)
 	case "cat":
-		if len(os.Args) < 3 {
+		var filter pathFilter
+		fs := flag.NewFlagSet("cat", flag.ExitOnError)
+		fs.Usage = usage
+		filterFlags(fs, &filter)
+		fs.Parse(os.Args[2:])
+		if fs.NArg() < 1 || fs.NArg() > 2 {
 			usage()
 			os.Exit(1)
 		}
-		if len(cfg.Restore.SecretFile) == 0 {
-			fmt.Fprintln(os.Stderr, "secretfile not set")
-			os.Exit(1)
+		if fs.NArg() > 1 {
+			if err = filter.addRegexp(fs.Arg(1)); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
 		}
-
-		skBytes, err := ioutil.ReadFile(cfg.Restore.SecretFile)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+		sk := openSecretKey(cfg)
+		gErr = cat(ctx, sk, fs.Arg(0), &filter)
+	case "restore":
+		var opts restoreOptions
+		var filter pathFilter
+		fs := flag.NewFlagSet("restore", flag.ExitOnError)
+		fs.Usage = usage
+		snapshotFlags(fs, &opts.snapshotOptions)
+		fs.BoolVar(&opts.dryRun, "dry-run", false,
+			"report the actions without touching the destination")
+		conflicts := []struct {
+			policy conflictPolicy
+			usage  string
+			set    *bool
+		}{
+			{policy: conflictOverwrite, usage: "replace existing paths (default)"},
+			{policy: conflictSkip, usage: "leave existing paths alone"},
+			{policy: conflictRename, usage: "move existing paths to <path>.orig"},
+			{policy: conflictFail, usage: "abort when a path already exists"},
 		}
-		fmt.Fprintf(os.Stderr, "%q secret: ", cfg.Restore.SecretFile)
-		secret, err := term.ReadPassword(int(os.Stdin.Fd()))
-		fmt.Fprint(os.Stderr, "\n")
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+		for i := range conflicts {
+			conflicts[i].set = fs.Bool(conflicts[i].policy.String(), false,
+				conflicts[i].usage)
 		}
-		sk, _, err := keyfile.OpenSecretKey(bytes.NewReader(skBytes), secret)
-		zero(secret)
-		zero(skBytes)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+		pathFlags(fs, &opts, &filter)
+		fs.IntVar(&opts.jobs, "jobs", runtime.NumCPU(),
+			"number of files written concurrently")
+		fs.BoolVar(&opts.resume, "resume", false,
+			"continue the restore interrupted in the destination")
+		fs.BoolVar(&opts.verify, "verify", false,
+			"verify the destination against the backup signatures")
+		format := fs.String("format", "", "write the paths as a tar "+
+			"stream instead of to a destination: tar")
+		output := fs.String("o", "-", "file the stream is written to, "+
+			"- for stdout")
+		fs.Parse(os.Args[2:])
+		var chosen []string
+		for _, c := range conflicts {
+			if *c.set {
+				opts.conflict = c.policy
+				chosen = append(chosen, "--"+c.policy.String())
+			}
+		}
+		if len(chosen) > 1 {
+			fmt.Fprintf(os.Stderr, "%s are mutually exclusive\n",
+				strings.Join(chosen, " and "))
 			os.Exit(1)
 		}
-		gErr = cat(ctx, sk, os.Args[2])
-	case "restore":
-		if len(os.Args) < 3 {
-			usage()
+		if opts.dryRun && (opts.resume || opts.verify) {
+			fmt.Fprintln(os.Stderr, "--dry-run cannot be combined "+
+				"with --resume or --verify")
 			os.Exit(1)
 		}
-		destDir := filepath.Clean(os.Args[2])
+		switch *format {
+		case "":
+			destDir, ii := restoreArgs(fs, &filter, true)
 
-		var fileRegexp *regexp.Regexp
-		if len(os.Args) > 3 {
-			fileRegexp, err = regexp.Compile(os.Args[3])
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
+			sk := openSecretKey(cfg)
+			gErr = restore(ctx, sk, cfg.BackupPath, destDir, &filter, ii, opts)
+		case "tar":
+			if opts.dryRun || opts.resume || opts.verify ||
+				opts.rewriteSymlinks || len(chosen) > 0 {
+				fmt.Fprintln(os.Stderr, "--format tar cannot be "+
+					"combined with the options of a destination")
 				os.Exit(1)
 			}
-		}
-
-		ii := int32(-1)
-		if len(os.Args) > 4 {
-			i, err := strconv.ParseUint(os.Args[4], 10, 16)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
+			_, ii := restoreArgs(fs, &filter, false)
+			if *output == "-" && term.IsTerminal(int(os.Stdout.Fd())) {
+				fmt.Fprintln(os.Stderr, "refusing to write a tar "+
+					"stream to a terminal")
 				os.Exit(1)
 			}
-			ii = int32(i)
-		}
 
-		if len(cfg.Restore.SecretFile) == 0 {
-			fmt.Fprintln(os.Stderr, "secretfile not set")
+			sk := openSecretKey(cfg)
+			gErr = writeTar(ctx, sk, cfg.BackupPath, *output, &filter, ii,
+				opts)
+		default:
+			fmt.Fprintf(os.Stderr, "unsupported format %q\n", *format)
 			os.Exit(1)
 		}
-		skBytes, err := ioutil.ReadFile(cfg.Restore.SecretFile)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+	case "verify-restore":
+		var opts restoreOptions
+		var filter pathFilter
+		fs := flag.NewFlagSet("verify-restore", flag.ExitOnError)
+		fs.Usage = usage
+		snapshotFlags(fs, &opts.snapshotOptions)
+		pathFlags(fs, &opts, &filter)
+		fs.Parse(os.Args[2:])
+		destDir, ii := restoreArgs(fs, &filter, true)
+
+		sk := openSecretKey(cfg)
+		gErr = verifyRestore(ctx, sk, cfg.BackupPath, destDir, &filter, ii,
+			opts)
+	case "ls":
+		var opts lsOptions
+		fs := flag.NewFlagSet("ls", flag.ExitOnError)
+		fs.Usage = usage
+		snapshotFlags(fs, &opts.snapshotOptions)
+		level := fs.Int("level", -1, "list the state as of this level")
+		fs.BoolVar(&opts.long, "l", false, "long listing")
+		fs.BoolVar(&opts.recursive, "R", false, "list directories recursively")
+		fs.Parse(os.Args[2:])
+		if *level > math.MaxUint16 {
+			usage()
 			os.Exit(1)
 		}
-		fmt.Fprintf(os.Stderr, "%q secret: ", cfg.Restore.SecretFile)
-		secret, err := term.ReadPassword(int(os.Stdin.Fd()))
-		fmt.Fprint(os.Stderr, "\n")
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+
+		sk := openSecretKey(cfg)
+		gErr = ls(ctx, sk, cfg.BackupPath, int32(*level), opts, fs.Args())
+	case "get":
+		var opts snapshotOptions
+		fs := flag.NewFlagSet("get", flag.ExitOnError)
+		fs.Usage = usage
+		snapshotFlags(fs, &opts)
+		level := fs.Int("level", -1, "get the contents as of this level")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() != 1 || *level > math.MaxUint16 {
+			usage()
 			os.Exit(1)
 		}
-		sk, _, err := keyfile.OpenSecretKey(bytes.NewReader(skBytes), secret)
-		zero(secret)
-		zero(skBytes)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+
+		sk := openSecretKey(cfg)
+		gErr = get(ctx, sk, cfg.BackupPath, int32(*level), opts, fs.Arg(0), os.Stdout)
+	case "mount":
+		fs := flag.NewFlagSet("mount", flag.ExitOnError)
+		fs.Usage = usage
+		host := fs.String("host", "", "only mount the snapshots of host")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() != 1 {
+			usage()
 			os.Exit(1)
 		}
-		gErr = restore(ctx, sk, cfg.BackupPath, destDir, fileRegexp, ii)
+
+		sk := openSecretKey(cfg)
+		gErr = mount(ctx, sk, cfg.BackupPath, *host, fs.Arg(0))
 	default:
 		usage()
 		os.Exit(1)
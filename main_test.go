@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"flag"
+	"io"
+	"log"
+	"log/syslog"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/jrick/ss/keyfile"
+	"github.com/jrick/ss/stream"
+)
+
+// TestMain sends the syslog messages of backup to a socket of its own so
+// that the tests do not depend on a syslog daemon, and silences the restore
+// log.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	dir, err := os.MkdirTemp("", "multus-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	addr := filepath.Join(dir, "log")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr,
+		Net: "unixgram"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	sysLog, err = syslog.Dial("unixgram", addr, syslog.LOG_DEBUG|syslog.LOG_DAEMON,
+		"multus-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+
+	code := m.Run()
+	conn.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testBackup backs up a source tree of its own.
+type testBackup struct {
+	t         *testing.T
+	src       string
+	cfg       *config
+	pubKey    *stream.PublicKey
+	secretKey *stream.SecretKey
+}
+
+// newTestBackup returns a backup of an empty source directory.
+func newTestBackup(t *testing.T) *testBackup {
+	t.Helper()
+	pk, sk := new(bytes.Buffer), new(bytes.Buffer)
+	params := &keyfile.Argon2idParams{Time: 1, Memory: 64}
+	if _, err := keyfile.GenerateKeys(rand.Reader, pk, sk, []byte("test"), params, ""); err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := keyfile.ReadPublicKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretKey, _, err := keyfile.OpenSecretKey(sk, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err = os.Mkdir(src, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return &testBackup{
+		t:   t,
+		src: src,
+		cfg: &config{
+			BackupPath: filepath.Join(dir, "backup"),
+			Backup: BackupConfig{
+				Group:        g.Name,
+				MaxIntervals: 10,
+				GZLevel:      1,
+				Paths:        []string{src},
+			},
+		},
+		pubKey:    pubKey,
+		secretKey: secretKey,
+	}
+}
+
+// path returns the path of name below the source directory.
+func (tb *testBackup) path(name string) string {
+	return filepath.Join(tb.src, name)
+}
+
+// write writes data to name below the source directory, creating its
+// parents.
+func (tb *testBackup) write(name string, data []byte, perm os.FileMode) {
+	tb.t.Helper()
+	path := tb.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		tb.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, perm); err != nil {
+		tb.t.Fatal(err)
+	}
+	// WriteFile does not change the mode of an existing file.
+	if err := os.Chmod(path, perm); err != nil {
+		tb.t.Fatal(err)
+	}
+}
+
+// backup backs up the next level.
+func (tb *testBackup) backup() {
+	tb.t.Helper()
+	if err := backup(context.Background(), tb.pubKey, tb.cfg); err != nil {
+		tb.t.Fatal(err)
+	}
+}
+
+// restore restores the latest snapshot up to level to a new directory,
+// which is returned.
+func (tb *testBackup) restore(level int32, opts restoreOptions) string {
+	tb.t.Helper()
+	dest := filepath.Join(tb.t.TempDir(), "dest")
+	err := restore(context.Background(), tb.secretKey, tb.cfg.BackupPath,
+		dest, nil, level, opts)
+	if err != nil {
+		tb.t.Fatal(err)
+	}
+	return dest
+}
+
+// diff fails the test when the source directory differs from its restore
+// to dest.
+func (tb *testBackup) diff(dest string) {
+	tb.t.Helper()
+	out, err := exec.Command("diff", "-r", "--no-dereference", tb.src,
+		filepath.Join(dest, tb.src)).CombinedOutput()
+	if err != nil {
+		tb.t.Fatalf("diff: %v\n%s", err, out)
+	}
+}
+
+// stdout returns what f printed to stdout along with its error.  Tests using
+// it must not run in parallel.
+func stdout(t *testing.T, f func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		r.Close()
+		out <- b
+	}()
+	saved := os.Stdout
+	os.Stdout = w
+	err = f()
+	os.Stdout = saved
+	w.Close()
+	return string(<-out), err
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jrick/ss/stream"
+)
+
+// mountTimeout is how long the kernel caches entries and attributes.  The
+// backups never change while mounted.
+const mountTimeout = time.Hour
+
+// mountFS is a read-only view of the backups, laid out as
+// <host>/<snapshot>/<level>/<path>.  Snapshots are named by their RFC3339
+// timestamp, which --snapshot accepts, and levels hold the state as of that
+// increment.
+type mountFS struct {
+	secretKey *stream.SecretKey
+}
+
+// mountDir is a directory made up for the layout rather than backed up.
+type mountDir struct {
+	fs.Inode
+	mtime time.Time
+}
+
+// mountLevel is the root of the state of a snapshot as of a level.  Its
+// tree is replayed from the increments the first time it is looked into.
+type mountLevel struct {
+	mountDir
+	fsys   *mountFS
+	snapID snapshotID
+	chain  IncrementalFiles
+
+	mu     sync.Mutex
+	loaded bool
+}
+
+// mountEntry is a backed up path.  Regular files are rebuilt from their
+// records when opened.
+type mountEntry struct {
+	fs.Inode
+	level *mountLevel
+	e     *lsEntry
+}
+
+// mountFile is an open regular file, rebuilt in an unlinked temporary file.
+type mountFile struct {
+	f *os.File
+}
+
+var (
+	_ = (fs.NodeGetattrer)((*mountDir)(nil))
+	_ = (fs.NodeLookuper)((*mountLevel)(nil))
+	_ = (fs.NodeOpendirer)((*mountLevel)(nil))
+	_ = (fs.NodeGetattrer)((*mountEntry)(nil))
+	_ = (fs.NodeReadlinker)((*mountEntry)(nil))
+	_ = (fs.NodeOpener)((*mountEntry)(nil))
+	_ = (fs.NodeGetxattrer)((*mountEntry)(nil))
+	_ = (fs.NodeListxattrer)((*mountEntry)(nil))
+	_ = (fs.FileReader)((*mountFile)(nil))
+	_ = (fs.FileReleaser)((*mountFile)(nil))
+)
+
+// mount serves the snapshots of host, or of every host when empty, on
+// mountPoint until it is unmounted or ctx is canceled.
+func mount(ctx context.Context, secretKey *stream.SecretKey, sourceDir, host, mountPoint string) error {
+	insts, err := SnapshotList(ctx, secretKey, sourceDir)
+	if err != nil {
+		return err
+	}
+	snaps := snapshotIDs(insts, host)
+	if len(snaps) == 0 {
+		return fmt.Errorf("no backups found")
+	}
+
+	fsys := &mountFS{secretKey: secretKey}
+	root := &mountDir{mtime: time.Now()}
+	timeout := mountTimeout
+	server, err := fs.Mount(mountPoint, root, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:      "multus",
+			Name:        "multus",
+			Options:     []string{"ro"},
+			DirectMount: true,
+		},
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+		OnAdd: func(ctx context.Context) {
+			fsys.populate(ctx, &root.Inode, insts, host)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("mounted %d snapshots on %q", len(snaps), mountPoint)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := server.Unmount(); err != nil {
+				log.Printf("unmount %q: %v", mountPoint, err)
+			}
+		case <-done:
+		}
+	}()
+	server.Wait()
+	close(done)
+	return nil
+}
+
+// populate adds the host, snapshot and level directories of insts to root.
+// Only the levels following an unbroken chain of increments are added.
+func (fsys *mountFS) populate(ctx context.Context, root *fs.Inode, insts IncrementalFiles, host string) {
+	var cur snapshotID
+	var chain IncrementalFiles
+	var snap *fs.Inode
+	for _, inst := range insts {
+		if host != "" && inst.Hostname != host {
+			continue
+		}
+		snapID := snapshotID{Hostname: inst.Hostname, Timestamp: inst.Timestamp}
+		if inst.Increment == 0 {
+			hostDir := mountChild(ctx, root, inst.Hostname, inst.Timestamp)
+			snap = mountChild(ctx, hostDir,
+				inst.Timestamp.Format(time.RFC3339), inst.Timestamp)
+			cur, chain = snapID, nil
+		}
+		if snapID != cur || inst.Increment != uint16(len(chain)) {
+			log.Printf("snapshot %v: skipping level %d, an earlier "+
+				"increment is missing", snapID, inst.Increment)
+			continue
+		}
+		chain = append(chain, inst)
+		l := &mountLevel{
+			mountDir: mountDir{mtime: inst.Created},
+			fsys:     fsys,
+			snapID:   snapID,
+			chain:    chain[:len(chain):len(chain)],
+		}
+		ch := snap.NewPersistentInode(ctx, l,
+			fs.StableAttr{Mode: syscall.S_IFDIR})
+		snap.AddChild(strconv.Itoa(int(inst.Increment)), ch, false)
+	}
+}
+
+// mountChild returns the directory name of parent, adding it when missing.
+// The modification time of an existing directory is advanced to mtime.
+func mountChild(ctx context.Context, parent *fs.Inode, name string, mtime time.Time) *fs.Inode {
+	if ch := parent.GetChild(name); ch != nil {
+		if d, ok := ch.Operations().(*mountDir); ok && mtime.After(d.mtime) {
+			d.mtime = mtime
+		}
+		return ch
+	}
+	ch := parent.NewPersistentInode(ctx, &mountDir{mtime: mtime},
+		fs.StableAttr{Mode: syscall.S_IFDIR})
+	parent.AddChild(name, ch, false)
+	return ch
+}
+
+func (d *mountDir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = syscall.S_IFDIR | 0o555
+	out.Nlink = 1
+	out.SetTimes(nil, &d.mtime, &d.mtime)
+	return fs.OK
+}
+
+func (l *mountLevel) Opendir(ctx context.Context) syscall.Errno {
+	return l.load(ctx)
+}
+
+func (l *mountLevel) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if errno := l.load(ctx); errno != fs.OK {
+		return nil, errno
+	}
+	ch := l.GetChild(name)
+	if ch == nil {
+		return nil, syscall.ENOENT
+	}
+	var a fuse.AttrOut
+	if errno := ch.Operations().(fs.NodeGetattrer).Getattr(ctx, nil, &a); errno != fs.OK {
+		return nil, errno
+	}
+	out.Attr = a.Attr
+	return ch, fs.OK
+}
+
+// load replays the metadata of the chain of l and adds its paths below l.
+// A failed load is retried by the next lookup.
+func (l *mountLevel) load(ctx context.Context) syscall.Errno {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.loaded {
+		return fs.OK
+	}
+
+	tree := make(map[string]*lsEntry)
+	for _, inst := range l.chain {
+		r, err := openIncrement(inst, l.snapID, l.fsys.secretKey)
+		if err == nil {
+			err = lsReplay(ctx, r, tree, nil)
+			if cerr := r.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			log.Printf("%v level %d: %v", l.snapID, len(l.chain)-1, err)
+			return mountErrno(err)
+		}
+	}
+
+	sorted := make([]string, 0, len(tree))
+	for path := range tree {
+		sorted = append(sorted, path)
+	}
+	// Parents sort before the paths below them.
+	sort.Strings(sorted)
+	for _, path := range sorted {
+		if err := checkPath(path); err != nil {
+			log.Printf("%v: %v", l.snapID, err)
+			continue
+		}
+		dir, name := filepath.Split(path)
+		if name == "" {
+			// The level directory stands for the root.
+			continue
+		}
+		parent := &l.Inode
+		for _, c := range strings.Split(strings.Trim(dir, "/"), "/") {
+			if c == "" || parent == nil {
+				continue
+			}
+			if ch := parent.GetChild(c); ch != nil {
+				if !ch.IsDir() {
+					ch = nil
+				}
+				parent = ch
+				continue
+			}
+			// The parent was not backed up.
+			parent = mountChild(ctx, parent, c, l.mtime)
+		}
+		if parent == nil {
+			log.Printf("%v: %q: parent is not a directory", l.snapID,
+				path)
+			continue
+		}
+		e := tree[path]
+		ch := parent.NewPersistentInode(ctx, &mountEntry{level: l, e: e},
+			fs.StableAttr{Mode: mountMode(os.FileMode(e.md.Attribs.Mode))})
+		parent.AddChild(name, ch, true)
+	}
+	l.loaded = true
+	return fs.OK
+}
+
+func (n *mountEntry) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	a := n.e.md.Attribs
+	mtime := time.Unix(0, a.MTim)
+	out.Mode = mountMode(os.FileMode(a.Mode))
+	out.Size = uint64(a.Size)
+	out.Blocks = (out.Size + 511) / 512
+	out.Uid = a.UID
+	out.Gid = a.GID
+	out.Rdev = uint32(a.RDev)
+	out.Nlink = 1
+	out.SetTimes(nil, &mtime, &mtime)
+	return fs.OK
+}
+
+func (n *mountEntry) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if !isSymlink(os.FileMode(n.e.md.Attribs.Mode)) {
+		return nil, syscall.EINVAL
+	}
+	return []byte(n.e.target), fs.OK
+}
+
+func (n *mountEntry) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	if !os.FileMode(n.e.md.Attribs.Mode).IsRegular() {
+		return nil, 0, syscall.EINVAL
+	}
+	l := n.level
+	f, err := rebuild(ctx, l.fsys.secretKey, l.snapID, l.chain, n.e.md.Path)
+	if err != nil {
+		log.Printf("%v: %v", l.snapID, err)
+		return nil, 0, mountErrno(err)
+	}
+	return &mountFile{f: f}, fuse.FOPEN_KEEP_CACHE, fs.OK
+}
+
+func (n *mountEntry) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	xattrs, err := n.e.md.Xattrs()
+	if err != nil {
+		return 0, syscall.EIO
+	}
+	for _, x := range xattrs {
+		if x.Name != attr {
+			continue
+		}
+		if len(dest) < len(x.Value) {
+			return uint32(len(x.Value)), syscall.ERANGE
+		}
+		return uint32(copy(dest, x.Value)), fs.OK
+	}
+	return 0, syscall.ENODATA
+}
+
+func (n *mountEntry) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	xattrs, err := n.e.md.Xattrs()
+	if err != nil {
+		return 0, syscall.EIO
+	}
+	var names []byte
+	for _, x := range xattrs {
+		names = append(names, x.Name...)
+		names = append(names, 0)
+	}
+	if len(dest) < len(names) {
+		return uint32(len(names)), syscall.ERANGE
+	}
+	return uint32(copy(dest, names)), fs.OK
+}
+
+func (f *mountFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := f.f.ReadAt(dest, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fs.ToErrno(err)
+	}
+	return fuse.ReadResultData(dest[:n]), fs.OK
+}
+
+func (f *mountFile) Release(ctx context.Context) syscall.Errno {
+	return fs.ToErrno(f.f.Close())
+}
+
+// mountMode converts fileMode to the mode of a stat.
+func mountMode(fileMode os.FileMode) uint32 {
+	mode := uint32(tarMode(fileMode))
+	switch {
+	case isDir(fileMode):
+		mode |= syscall.S_IFDIR
+	case isSymlink(fileMode):
+		mode |= syscall.S_IFLNK
+	case isCharDevice(fileMode):
+		mode |= syscall.S_IFCHR
+	case isDevice(fileMode):
+		mode |= syscall.S_IFBLK
+	case isNamedPipe(fileMode):
+		mode |= syscall.S_IFIFO
+	case isSocket(fileMode):
+		mode |= syscall.S_IFSOCK
+	default:
+		mode |= syscall.S_IFREG
+	}
+	return mode
+}
+
+// mountErrno returns the errno reported to the kernel for err.
+func mountErrno(err error) syscall.Errno {
+	var errno syscall.Errno
+	switch {
+	case errors.As(err, &errno):
+		return errno
+	case errors.Is(err, context.Canceled):
+		return syscall.EINTR
+	case errors.Is(err, os.ErrNotExist):
+		return syscall.ENOENT
+	}
+	return syscall.EIO
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// testMount drives the node tree of a mount through the operations the
+// kernel would send, without mounting it.
+type testMount struct {
+	t   *testing.T
+	raw fuse.RawFileSystem
+}
+
+func newTestMount(t *testing.T, tb *testBackup) *testMount {
+	t.Helper()
+	insts, err := SnapshotList(context.Background(), tb.secretKey, tb.cfg.BackupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := &mountFS{secretKey: tb.secretKey}
+	root := &mountDir{mtime: time.Now()}
+	raw := fs.NewNodeFS(root, &fs.Options{
+		OnAdd: func(ctx context.Context) {
+			fsys.populate(ctx, &root.Inode, insts, "")
+		},
+	})
+	return &testMount{t: t, raw: raw}
+}
+
+// lookup looks up the components of path from the root and returns the
+// entry of the last one.
+func (m *testMount) lookup(path string) (*fuse.EntryOut, fuse.Status) {
+	out := &fuse.EntryOut{NodeId: 1}
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return out, fuse.OK
+	}
+	for _, name := range strings.Split(path, "/") {
+		parent := out.NodeId
+		out = new(fuse.EntryOut)
+		st := m.raw.Lookup(nil, &fuse.InHeader{NodeId: parent}, name, out)
+		if !st.Ok() {
+			return nil, st
+		}
+	}
+	return out, fuse.OK
+}
+
+func (m *testMount) mustLookup(path string) *fuse.EntryOut {
+	m.t.Helper()
+	out, st := m.lookup(path)
+	if !st.Ok() {
+		m.t.Fatalf("lookup %q: %v", path, st)
+	}
+	return out
+}
+
+// readdir returns the sorted names in the directory path.
+func (m *testMount) readdir(path string) []string {
+	m.t.Helper()
+	id := m.mustLookup(path).NodeId
+	var open fuse.OpenOut
+	if st := m.raw.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: id}}, &open); !st.Ok() {
+		m.t.Fatalf("opendir %q: %v", path, st)
+	}
+	defer m.raw.ReleaseDir(&fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: id}, Fh: open.Fh})
+
+	var names []string
+	var off uint64
+	for {
+		buf := make([]byte, 4096)
+		in := &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: id}, Fh: open.Fh,
+			Offset: off, Size: uint32(len(buf))}
+		if st := m.raw.ReadDir(nil, in, fuse.NewDirEntryList(buf, off)); !st.Ok() {
+			m.t.Fatalf("readdir %q: %v", path, st)
+		}
+		// Each entry is its inode, offset, name length and type
+		// followed by its name padded to 8 bytes.
+		n := len(names)
+		for len(buf) >= 24 {
+			nameLen := int(binary.LittleEndian.Uint32(buf[16:]))
+			if nameLen == 0 {
+				break
+			}
+			off = binary.LittleEndian.Uint64(buf[8:])
+			if name := string(buf[24 : 24+nameLen]); name != "." && name != ".." {
+				names = append(names, name)
+			}
+			buf = buf[(24+nameLen+7)&^7:]
+		}
+		if len(names) == n {
+			break
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// read returns the contents of the file path.
+func (m *testMount) read(path string) []byte {
+	m.t.Helper()
+	e := m.mustLookup(path)
+	var open fuse.OpenOut
+	in := &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: e.NodeId}, Flags: syscall.O_RDONLY}
+	if st := m.raw.Open(nil, in, &open); !st.Ok() {
+		m.t.Fatalf("open %q: %v", path, st)
+	}
+	defer m.raw.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: e.NodeId}, Fh: open.Fh})
+
+	var data []byte
+	buf := make([]byte, 4096)
+	for {
+		res, st := m.raw.Read(nil, &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: e.NodeId},
+			Fh: open.Fh, Offset: uint64(len(data)), Size: uint32(len(buf))}, buf)
+		if !st.Ok() {
+			m.t.Fatalf("read %q: %v", path, st)
+		}
+		b, st := res.Bytes(buf)
+		if !st.Ok() {
+			m.t.Fatalf("read %q: %v", path, st)
+		}
+		if len(b) == 0 {
+			break
+		}
+		data = append(data, b...)
+	}
+	if uint64(len(data)) != e.Attr.Size {
+		m.t.Errorf("%q: read %d bytes of %d", path, len(data), e.Attr.Size)
+	}
+	return data
+}
+
+func TestMountTree(t *testing.T) {
+	tb := newTestBackup(t)
+	large := make([]byte, 10000)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	tb.write("dir/file", []byte("first\n"), 0o640)
+	tb.write("dir/large", large, 0o644)
+	tb.write("deleted", []byte("deleted\n"), 0o644)
+	if err := os.Symlink("dir/file", tb.path("symlink")); err != nil {
+		t.Fatal(err)
+	}
+	tb.backup()
+	tb.write("dir/file", []byte("second\n"), 0o640)
+	if err := os.Remove(tb.path("deleted")); err != nil {
+		t.Fatal(err)
+	}
+	tb.backup()
+
+	m := newTestMount(t, tb)
+	hosts := m.readdir("/")
+	if len(hosts) != 1 {
+		t.Fatalf("hosts %v", hosts)
+	}
+	snaps := m.readdir(hosts[0])
+	if len(snaps) != 1 {
+		t.Fatalf("snapshots %v", snaps)
+	}
+	if _, err := time.Parse(time.RFC3339, snaps[0]); err != nil {
+		t.Errorf("snapshot named %q: %v", snaps[0], err)
+	}
+	snap := hosts[0] + "/" + snaps[0]
+	if levels := m.readdir(snap); strings.Join(levels, " ") != "0 1" {
+		t.Fatalf("levels %v", levels)
+	}
+
+	for level, want := range []struct {
+		names []string
+		file  string
+	}{
+		{[]string{"deleted", "dir", "symlink"}, "first\n"},
+		{[]string{"dir", "symlink"}, "second\n"},
+	} {
+		root := snap + "/" + strconv.Itoa(level)
+		if names := m.readdir(root + tb.src); strings.Join(names, " ") !=
+			strings.Join(want.names, " ") {
+			t.Errorf("level %d: source directory holds %v, want %v", level,
+				names, want.names)
+		}
+		e := m.mustLookup(root + tb.path("dir/file"))
+		if e.Attr.Mode != syscall.S_IFREG|0o640 {
+			t.Errorf("level %d: file mode %o", level, e.Attr.Mode)
+		}
+		if got := m.read(root + tb.path("dir/file")); string(got) != want.file {
+			t.Errorf("level %d: file holds %q, want %q", level, got, want.file)
+		}
+		if got := m.read(root + tb.path("dir/large")); string(got) != string(large) {
+			t.Errorf("level %d: large file differs", level)
+		}
+
+		e = m.mustLookup(root + tb.path("symlink"))
+		target, st := m.raw.Readlink(nil, &fuse.InHeader{NodeId: e.NodeId})
+		if !st.Ok() || string(target) != "dir/file" {
+			t.Errorf("level %d: symlink to %q: %v", level, target, st)
+		}
+		e = m.mustLookup(root + tb.path("dir"))
+		if _, st = m.raw.Readlink(nil, &fuse.InHeader{NodeId: e.NodeId}); st != fuse.EINVAL {
+			t.Errorf("level %d: readlink of a directory: %v", level, st)
+		}
+	}
+
+	if _, st := m.lookup(snap + "/1" + tb.path("deleted")); st != fuse.ENOENT {
+		t.Errorf("deleted file looked up: %v", st)
+	}
+	e := m.mustLookup(snap + "/1" + tb.path("dir/file"))
+	in := &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: e.NodeId}, Flags: syscall.O_RDWR}
+	if st := m.raw.Open(nil, in, new(fuse.OpenOut)); st != fuse.EROFS {
+		t.Errorf("opened for writing: %v", st)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jrick/ss/stream"
+)
+
+// Backups can only be mounted on Linux.
+
+func mount(ctx context.Context, secretKey *stream.SecretKey, sourceDir, host, mountPoint string) error {
+	return errors.New("mount is only supported on Linux")
+}
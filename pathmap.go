@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// pathMapping replaces the leading directory old of archive paths with new.
+type pathMapping struct {
+	old string
+	new string
+}
+
+// parsePathMapping parses an old=new --map option.
+func parsePathMapping(s string) (pathMapping, error) {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return pathMapping{}, fmt.Errorf("%q: expected old=new", s)
+	}
+	old, err := absPath(s[:i])
+	if err != nil {
+		return pathMapping{}, err
+	}
+	new, err := absPath(s[i+1:])
+	if err != nil {
+		return pathMapping{}, err
+	}
+	return pathMapping{old: old, new: new}, nil
+}
+
+// absPath cleans an absolute path given on the command line.
+func absPath(s string) (string, error) {
+	if !filepath.IsAbs(s) {
+		return "", fmt.Errorf("%q: not an absolute path", s)
+	}
+	return filepath.Clean(s), nil
+}
+
+// pathRewriter selects the archive paths to restore and rewrites them to
+// paths below the destination.  Mappings are applied first, the first one
+// matching wins, followed by stripPrefix.  The filter matches the rewritten
+// paths.
+type pathRewriter struct {
+	stripPrefix string
+	maps        []pathMapping
+	filter      *pathFilter
+
+	// symlinks rewrites absolute symlink targets that fall under a
+	// mapping or stripPrefix to point inside the destination.
+	symlinks bool
+}
+
+// mapPath applies the mappings and stripPrefix to path.  False is returned
+// for paths outside of stripPrefix.
+func (pr *pathRewriter) mapPath(path string) (string, bool) {
+	for _, m := range pr.maps {
+		if rest, ok := cutDir(path, m.old); ok {
+			path = filepath.Clean(m.new + rest)
+			break
+		}
+	}
+	if pr.stripPrefix == "" {
+		return path, true
+	}
+	rest, ok := cutDir(path, pr.stripPrefix)
+	if !ok {
+		return "", false
+	}
+	if rest == "" {
+		rest = "/"
+	}
+	return rest, true
+}
+
+// rewrite returns the path below the destination of the archive path and
+// whether it is selected.
+func (pr *pathRewriter) rewrite(path string) (string, bool) {
+	path, ok := pr.mapPath(path)
+	if !ok {
+		return "", false
+	}
+	if !pr.filter.match(path) {
+		return "", false
+	}
+	return path, true
+}
+
+// selective reports whether some archive paths are not restored.
+func (pr *pathRewriter) selective() bool {
+	return pr.stripPrefix != "" || pr.filter.selective()
+}
+
+// match reports whether the archive path is restored.
+func (pr *pathRewriter) match(path string) bool {
+	_, ok := pr.rewrite(path)
+	return ok
+}
+
+// rewriteTarget returns the symlink target to restore below destDir.
+func (pr *pathRewriter) rewriteTarget(target, destDir string) string {
+	if !pr.symlinks || !filepath.IsAbs(target) {
+		return target
+	}
+	clean := filepath.Clean(target)
+	rewritten := false
+	for _, m := range pr.maps {
+		if _, ok := cutDir(clean, m.old); ok {
+			rewritten = true
+			break
+		}
+	}
+	if !rewritten {
+		_, rewritten = cutDir(clean, pr.stripPrefix)
+	}
+	if !rewritten {
+		return target
+	}
+	path, ok := pr.mapPath(clean)
+	if !ok {
+		// Mapped outside of stripPrefix.
+		return target
+	}
+	return filepath.Join(destDir, path)
+}
+
+// cutDir returns path with the leading directory dir removed.
+func cutDir(path, dir string) (string, bool) {
+	switch {
+	case dir == "":
+		return "", false
+	case dir == "/":
+		return path, true
+	case path == dir:
+		return "", true
+	case strings.HasPrefix(path, dir+"/"):
+		return path[len(dir):], true
+	}
+	return "", false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePathMapping(t *testing.T) {
+	tests := []struct {
+		s    string
+		want pathMapping
+		ok   bool
+	}{
+		{"/a=/b", pathMapping{old: "/a", new: "/b"}, true},
+		{"/a/../c/=/b//d", pathMapping{old: "/c", new: "/b/d"}, true},
+		{"/a=b", pathMapping{}, false},
+		{"a=/b", pathMapping{}, false},
+		{"/a", pathMapping{}, false},
+	}
+	for _, tt := range tests {
+		m, err := parsePathMapping(tt.s)
+		if (err == nil) != tt.ok || m != tt.want {
+			t.Errorf("%q: parsed %+v, %v", tt.s, m, err)
+		}
+	}
+}
+
+func TestPathRewriter(t *testing.T) {
+	maps := []pathMapping{
+		{old: "/home/alice", new: "/home/bob"},
+		{old: "/home", new: "/users"},
+		{old: "/srv", new: "/home/carol"},
+	}
+	tests := []struct {
+		name        string
+		stripPrefix string
+		maps        []pathMapping
+		path        string
+		want        string
+		ok          bool
+	}{
+		{"none", "", nil, "/etc/fstab", "/etc/fstab", true},
+		{"strip", "/home/alice", nil, "/home/alice/notes", "/notes", true},
+		{"strip root", "/home/alice", nil, "/home/alice", "/", true},
+		{"outside strip", "/home/alice", nil, "/home/alicex", "", false},
+		{"strip /", "/", nil, "/etc", "/etc", true},
+		{"first map wins", "", maps, "/home/alice/notes", "/home/bob/notes", true},
+		{"second map", "", maps, "/home/dave/notes", "/users/dave/notes", true},
+		{"one map only", "", maps, "/srv/www", "/home/carol/www", true},
+		{"unmapped", "", maps, "/etc/fstab", "/etc/fstab", true},
+		{"map then strip", "/users", maps, "/home/dave/notes", "/dave/notes", true},
+		{"mapped outside strip", "/users", maps, "/home/alice/notes", "", false},
+	}
+	for _, tt := range tests {
+		pr := &pathRewriter{stripPrefix: tt.stripPrefix, maps: tt.maps}
+		got, ok := pr.rewrite(tt.path)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: %q rewritten to %q, %v, want %q, %v", tt.name,
+				tt.path, got, ok, tt.want, tt.ok)
+		}
+		if pr.selective() != (tt.stripPrefix != "") {
+			t.Errorf("%s: selective %v", tt.name, pr.selective())
+		}
+	}
+
+	// The filter matches the rewritten paths.
+	f := new(pathFilter)
+	if err := f.addInclude("/dave"); err != nil {
+		t.Fatal(err)
+	}
+	pr := &pathRewriter{stripPrefix: "/users", maps: maps, filter: f}
+	if _, ok := pr.rewrite("/home/dave/notes"); !ok {
+		t.Error("rewritten path not matched")
+	}
+	if pr.match("/dave/notes") {
+		t.Error("archive path matched")
+	}
+}
+
+func TestRewriteTarget(t *testing.T) {
+	pr := &pathRewriter{
+		stripPrefix: "/users",
+		maps:        []pathMapping{{old: "/home", new: "/users"}},
+		symlinks:    true,
+	}
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/home/dave/notes", "/dest/dave/notes"},
+		{"/users/dave", "/dest/dave"},
+		{"/etc/fstab", "/etc/fstab"},
+		{"../notes", "../notes"},
+		{"/home/../etc", "/home/../etc"},
+	}
+	for _, tt := range tests {
+		if got := pr.rewriteTarget(tt.target, "/dest"); got != tt.want {
+			t.Errorf("%q rewritten to %q, want %q", tt.target, got, tt.want)
+		}
+	}
+
+	pr.symlinks = false
+	if got := pr.rewriteTarget("/home/dave", "/dest"); got != "/home/dave" {
+		t.Errorf("rewritten to %q without symlinks", got)
+	}
+}
+
+func TestRestorePathMapping(t *testing.T) {
+	tb := newTestBackup(t)
+	tb.write("keep/file", []byte("file\n"), 0o644)
+	tb.write("other/file", []byte("other\n"), 0o644)
+	if err := os.Symlink(tb.path("keep/file"), tb.path("keep/link")); err != nil {
+		t.Fatal(err)
+	}
+	tb.backup()
+
+	dest := tb.restore(-1, restoreOptions{
+		stripPrefix:     "/mapped",
+		maps:            []pathMapping{{old: tb.path("keep"), new: "/mapped"}},
+		rewriteSymlinks: true,
+	})
+	b, err := os.ReadFile(filepath.Join(dest, "file"))
+	if err != nil || string(b) != "file\n" {
+		t.Errorf("mapped file: %q, %v", b, err)
+	}
+	target, err := os.Readlink(filepath.Join(dest, "link"))
+	if err != nil || target != filepath.Join(dest, "file") {
+		t.Errorf("mapped symlink to %q, %v", target, err)
+	}
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "file" && e.Name() != "link" {
+			t.Errorf("%s restored", e.Name())
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+	"multus/archive"
+)
+
+// pipeline applies the records of a restore on a bounded pool of workers
+// while they are decoded on a single goroutine.  A record is only started
+// once the earlier records of its path, of its parent directories, of the
+// paths below it and of its hard link target have been applied, so every
+// path sees its records in order across levels.
+type pipeline struct {
+	ctx context.Context
+	eg  *errgroup.Group
+	rs  *restorer
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	inFlight map[string]int
+}
+
+// newPipeline returns a pipeline applying records to rs on workers
+// goroutines and a context canceled once one of them fails.
+func newPipeline(ctx context.Context, rs *restorer, workers int) (*pipeline, context.Context) {
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(workers)
+	pl := &pipeline{
+		ctx:      ctx,
+		eg:       eg,
+		rs:       rs,
+		inFlight: make(map[string]int),
+	}
+	pl.cond = sync.NewCond(&pl.mu)
+	return pl, ctx
+}
+
+// record hands rec to a worker.  Data up to memoryLimit is read ahead so
+// that decoding can continue, while larger records are streamed to the
+// worker and waited for.
+func (pl *pipeline) record(r *archive.Reader, i int, rec *archive.Record) error {
+	if err := checkPath(rec.Metadata.Path); err != nil {
+		return err
+	}
+	path, ok := pl.rs.paths.rewrite(rec.Metadata.Path)
+	if !ok {
+		return nil
+	}
+	if pl.rs.journal.completed(journalKey{level: r.Header.Increment, index: i}) {
+		// Only its deferred metadata is replayed.
+		return pl.rs.record(r, i, rec)
+	}
+	keys := []string{path}
+	if target, ok := rec.Metadata.Link(); ok {
+		if mapped, ok := pl.rs.paths.mapPath(target); ok {
+			keys = append(keys, mapped)
+		}
+	}
+
+	var done chan struct{}
+	if rec.DataLen <= memoryLimit {
+		buf := make([]byte, rec.DataLen)
+		if _, err := io.ReadFull(rec.Data, buf); err != nil {
+			return err
+		}
+		rec.Data = bytes.NewReader(buf)
+	} else {
+		done = make(chan struct{})
+	}
+
+	pl.acquire(keys)
+	pl.eg.Go(func() error {
+		defer pl.release(keys)
+		if done != nil {
+			defer close(done)
+		}
+		if pl.ctx.Err() != nil {
+			return pl.ctx.Err()
+		}
+		return pl.rs.record(r, i, rec)
+	})
+	if done != nil {
+		<-done
+	}
+	return nil
+}
+
+// drain waits until every record handed out has been applied.
+func (pl *pipeline) drain() {
+	pl.mu.Lock()
+	for len(pl.inFlight) > 0 {
+		pl.cond.Wait()
+	}
+	pl.mu.Unlock()
+}
+
+// wait waits for every record handed out and returns the first error.
+func (pl *pipeline) wait() error {
+	return pl.eg.Wait()
+}
+
+// acquire waits until no record related to keys is being applied and marks
+// them as in flight.
+func (pl *pipeline) acquire(keys []string) {
+	pl.mu.Lock()
+	for pl.busy(keys) {
+		pl.cond.Wait()
+	}
+	for _, k := range keys {
+		pl.inFlight[k]++
+	}
+	pl.mu.Unlock()
+}
+
+func (pl *pipeline) release(keys []string) {
+	pl.mu.Lock()
+	for _, k := range keys {
+		if pl.inFlight[k]--; pl.inFlight[k] == 0 {
+			delete(pl.inFlight, k)
+		}
+	}
+	pl.mu.Unlock()
+	pl.cond.Broadcast()
+}
+
+// busy reports whether a record of one of keys, of a parent or of a path
+// below it is in flight.  Only the records held by workers are in flight.
+func (pl *pipeline) busy(keys []string) bool {
+	for k := range pl.inFlight {
+		for _, key := range keys {
+			if _, ok := cutDir(k, key); ok {
+				return true
+			}
+			if _, ok := cutDir(key, k); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPipelineBusy(t *testing.T) {
+	tests := []struct {
+		inFlight string
+		keys     []string
+		want     bool
+	}{
+		{"/a", []string{"/a"}, true},
+		{"/a", []string{"/a/b"}, true},
+		{"/a/b", []string{"/a"}, true},
+		{"/", []string{"/a"}, true},
+		{"/a", []string{"/ab"}, false},
+		{"/a/b", []string{"/a/c"}, false},
+		{"/a", []string{"/c", "/a/b"}, true},
+	}
+	for _, tt := range tests {
+		pl, _ := newPipeline(context.Background(), nil, 1)
+		pl.acquire([]string{tt.inFlight})
+		if got := pl.busy(tt.keys); got != tt.want {
+			t.Errorf("%q in flight: %q busy %v, want %v", tt.inFlight,
+				tt.keys, got, tt.want)
+		}
+	}
+}
+
+func TestPipelineAcquire(t *testing.T) {
+	pl, _ := newPipeline(context.Background(), nil, 1)
+	pl.acquire([]string{"/a"})
+	pl.acquire([]string{"/c"})
+
+	acquired := make(chan struct{})
+	go func() {
+		pl.acquire([]string{"/a/b"})
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("path below one in flight acquired")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pl.release([]string{"/c"})
+	select {
+	case <-acquired:
+		t.Fatal("acquired once an unrelated path was released")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pl.release([]string{"/a"})
+	select {
+	case <-acquired:
+	case <-time.After(10 * time.Second):
+		t.Fatal("not acquired once its parent was released")
+	}
+	pl.release([]string{"/a/b"})
+	if len(pl.inFlight) != 0 {
+		t.Errorf("left in flight: %v", pl.inFlight)
+	}
+}
+
+func TestRestoreJobs(t *testing.T) {
+	tb := newTestBackup(t)
+	for i := 0; i < 20; i++ {
+		tb.write(fmt.Sprintf("x/%d", i), []byte(fmt.Sprintf("x %d\n", i)), 0o644)
+		tb.write(fmt.Sprintf("y/%d", i), []byte(fmt.Sprintf("y %d\n", i)), 0o644)
+	}
+	tb.write("d/1", []byte("linked\n"), 0o644)
+	if err := os.Link(tb.path("d/1"), tb.path("h")); err != nil {
+		t.Fatal(err)
+	}
+	tb.backup()
+
+	// Every level changes the paths below directories whose metadata
+	// changes too, and a file behind a hard link.
+	for i := 0; i < 20; i += 2 {
+		if err := os.Remove(tb.path(fmt.Sprintf("x/%d", i))); err != nil {
+			t.Fatal(err)
+		}
+		tb.write(fmt.Sprintf("x/new/%d", i), []byte(fmt.Sprintf("new %d\n", i)), 0o600)
+		tb.write(fmt.Sprintf("y/%d", i), []byte(fmt.Sprintf("y %d changed\n", i)), 0o600)
+	}
+	tb.write("d/1", []byte("linked, changed\n"), 0o644)
+	if err := os.Chmod(tb.path("x"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	tb.backup()
+
+	for i := 0; i < 20; i++ {
+		tb.write(fmt.Sprintf("y/%d", i), []byte(fmt.Sprintf("y %d changed again\n", i)), 0o644)
+	}
+	for i := 0; i < 20; i += 4 {
+		if err := os.Remove(tb.path(fmt.Sprintf("x/new/%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(tb.path("y"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(tb.path("x/new"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	tb.backup()
+
+	for _, jobs := range []int{1, 4, 16} {
+		dest := tb.restore(-1, restoreOptions{jobs: jobs})
+		tb.diff(dest)
+		for name, perm := range map[string]os.FileMode{
+			"x":     0o750,
+			"x/new": 0o700,
+			"y":     0o700,
+		} {
+			fi, err := os.Stat(dest + tb.path(name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != perm {
+				t.Errorf("%d jobs: %s restored with mode %v", jobs, name,
+					fi.Mode())
+			}
+		}
+		a, err := os.Stat(dest + tb.path("d/1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.Stat(dest + tb.path("h"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(a, b) {
+			t.Errorf("%d jobs: hard link not restored", jobs)
+		}
+	}
+}
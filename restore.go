@@ -1,444 +1,881 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strconv"
-	"strings"
+	"runtime"
+	"sort"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/jrick/ss/stream"
 	"github.com/smtc/rsync"
-	"golang.org/x/sync/errgroup"
+	"golang.org/x/sys/unix"
+	"multus/archive"
 )
 
-func restore(ctx context.Context, secretKey *stream.SecretKey, sourceDir, destDir string, fileRegexp *regexp.Regexp, level int32) error {
-	insts, err := SnapshotList(ctx, secretKey, sourceDir)
+// restoreOptions holds the restore command line options.
+type restoreOptions struct {
+	snapshotOptions
+
+	// dryRun reports the actions a restore would take without
+	// touching the destination.
+	dryRun bool
+
+	// conflict selects what is done with existing paths of the
+	// destination.
+	conflict conflictPolicy
+
+	// stripPrefix and maps rewrite archive paths to paths below the
+	// destination.
+	stripPrefix string
+	maps        []pathMapping
+
+	// rewriteSymlinks rewrites absolute symlink targets along with the
+	// paths.
+	rewriteSymlinks bool
+
+	// jobs is the number of records applied concurrently.
+	jobs int
+
+	// resume continues the interrupted restore journaled in the
+	// destination.
+	resume bool
+
+	// verify compares the destination with the backup signatures once
+	// restored.
+	verify bool
+}
+
+// recordFunc handles the record of an increment at position i.
+type recordFunc func(r *archive.Reader, i int, rec *archive.Record) error
+
+func restore(ctx context.Context, secretKey *stream.SecretKey, sourceDir, destDir string, filter *pathFilter, level int32, opts restoreOptions) error {
+	var j *journal
+	if opts.resume {
+		var err error
+		if j, err = openJournal(destDir); err != nil {
+			return err
+		}
+		defer j.Close()
+		if opts.snapshot == "" && opts.at.IsZero() {
+			// Carry on with the snapshot and level journaled.
+			opts.snapshot = j.snapID.Timestamp.Format(time.RFC3339)
+			opts.host = j.snapID.Hostname
+			if level < 0 {
+				level = j.level
+			}
+		}
+	}
+	snapID, chain, err := selectChain(ctx, secretKey, sourceDir, level,
+		opts.snapshotOptions)
 	if err != nil {
 		return err
 	}
-	if len(insts) == 0 {
-		return fmt.Errorf("no backups found")
+	level = int32(len(chain) - 1)
+	if j != nil && (!snapID.Timestamp.Equal(j.snapID.Timestamp) ||
+		snapID.Hostname != j.snapID.Hostname || level != j.level) {
+		return fmt.Errorf("%q: the interrupted restore is of %v level "+
+			"%d", j.path, j.snapID, j.level)
 	}
 
-	idx := 0
-	snapList := make(map[time.Time]int)
-	for _, inst := range insts {
-		i, exists := snapList[inst.Timestamp]
-		if !exists {
-			snapList[inst.Timestamp] = idx
-			idx++
-			continue
+	paths := &pathRewriter{
+		stripPrefix: opts.stripPrefix,
+		maps:        opts.maps,
+		filter:      filter,
+		symlinks:    opts.rewriteSymlinks,
+	}
+	settings := journalSettings(paths, opts.conflict)
+	if j != nil && settings != j.settings {
+		return fmt.Errorf("%q: the interrupted restore was started with "+
+			"other path, filter or conflict options, resume it with "+
+			"the same ones", j.path)
+	}
+
+	// Verify every increment before anything is applied.
+	if err = verifyChain(chain, secretKey); err != nil {
+		return err
+	}
+
+	log.Printf("Restoring to level %d...", level)
+	startTime := time.Now()
+	// The context of the pipeline is done once it has been waited for.
+	verifyCtx := ctx
+	rs := newRestorer(destDir, paths, opts.conflict)
+	rs.rebuild = func(path string, level uint16) (*os.File, error) {
+		return rebuild(ctx, secretKey, snapID, chain[:level+1], path)
+	}
+	var apply recordFunc
+	var plan *restorePlan
+	var pl *pipeline
+	if opts.dryRun {
+		plan = newRestorePlan(destDir, paths, opts.conflict)
+		apply = plan.record
+	} else {
+		if j != nil {
+			err = rs.resume(j)
+		} else {
+			j, err = createJournal(destDir, snapID, level, settings)
+			if err == nil {
+				defer j.Close()
+			}
+			rs.journal = j
 		}
-		if i > idx {
-			snapList[inst.Timestamp] = i
+		if err != nil {
+			return err
+		}
+		jobs := opts.jobs
+		if jobs < 1 {
+			jobs = runtime.NumCPU()
 		}
+		pl, ctx = newPipeline(ctx, rs, jobs)
+		apply = pl.record
 	}
-
-	snapID := insts[0].Timestamp
-	if len(snapList) > 1 {
-		fmt.Println("snapshots:")
-		for ts, idx := range snapList {
-			log.Printf("%d: %v", idx, ts)
+	for _, inst := range chain {
+		log.Printf("----------  APPLYING LEVEL %d  -----------", inst.Increment)
+		log.Printf("file: %q", inst.Filename)
+		r, err := openIncrement(inst, snapID, secretKey)
+		if err == nil {
+			err = restoreIncrement(ctx, r, paths, apply)
+			if cerr := r.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err == nil && pl != nil {
+			// The level is only complete once every record was
+			// applied.
+			pl.drain()
+			if err = ctx.Err(); err == nil {
+				err = rs.endLevel(inst.Increment)
+			}
 		}
-		reader := bufio.NewReader(os.Stdin)
-		fmt.Fprintf(os.Stderr, "enter id to restore: ")
-		os.Stderr.Sync()
-		t, err := reader.ReadString('\n')
 		if err != nil {
+			if pl != nil {
+				// A failed worker cancels the decoding, so its
+				// error is the one to report.
+				if werr := pl.wait(); werr != nil {
+					err = werr
+				}
+			}
+			return err
+		}
+	}
+	if plan != nil {
+		plan.summary()
+		return nil
+	}
+	if err = pl.wait(); err != nil {
+		return err
+	}
+	// The journal is removed first so that the metadata of the
+	// destination root is left as restored.
+	if err = rs.journal.remove(); err != nil {
+		return err
+	}
+	rs.pending.apply(&rs.dest)
+	log.Printf("completed in %v", time.Since(startTime))
+	if opts.verify {
+		// Verify the snapshot restored rather than select it again.
+		opts.snapshot = snapID.Timestamp.Format(time.RFC3339)
+		opts.host = snapID.Hostname
+		opts.at = time.Time{}
+		return verifyRestore(verifyCtx, secretKey, sourceDir, destDir,
+			filter, level, opts)
+	}
+	return nil
+}
+
+// verifyChain verifies every increment of chain against its trailer.
+// Indexed increments are read in full too, as seeking skips the trailer.
+func verifyChain(chain IncrementalFiles, secretKey *stream.SecretKey) error {
+	for _, inst := range chain {
+		if err := verifyIncrement(inst.Filename, secretKey); err != nil {
 			return err
 		}
-		t = strings.Replace(t, "\n", "", -1)
-		fmt.Fprint(os.Stderr, "\n")
+	}
+	return nil
+}
+
+func verifyIncrement(file string, secretKey *stream.SecretKey) error {
+	log.Printf("verifying %q", file)
+	_, trailer, err := archive.Verify(file, secretKey)
+	if err != nil {
+		return err
+	}
+	if trailer == nil {
+		log.Printf("%q: no trailer, only checked for truncation", file)
+	}
+	return nil
+}
 
-		u, err := strconv.ParseUint(t, 10, 64)
+// restoreIncrement passes the records of r, or only those selected by paths
+// when r is indexed, to apply.
+func restoreIncrement(ctx context.Context, r *archive.Reader, paths *pathRewriter, apply recordFunc) error {
+	if paths.selective() {
+		index, err := r.Index()
 		if err != nil {
 			return err
 		}
-		var found bool
-		for ts, idx := range snapList {
-			if uint64(idx) == u {
-				snapID = ts
-				found = true
-				break
+		if index != nil {
+			return restoreIndexed(ctx, r, index, paths, apply)
+		}
+	}
+	for i := 0; ; i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rec, err := r.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
 			}
+			return err
 		}
-		if !found {
-			return fmt.Errorf("invalid id '%d'", u)
+		if err = apply(r, i, rec); err != nil {
+			return err
 		}
 	}
+}
 
-	var maxLevel int32
-	for _, inst := range insts {
-		if inst.Timestamp == snapID {
-			maxLevel++
+// restoreIndexed only decodes the blocks holding records selected by paths.
+func restoreIndexed(ctx context.Context, r *archive.Reader, index []archive.IndexEntry, paths *pathRewriter, apply recordFunc) error {
+	// next is the record the reader is positioned at.
+	next := 0
+	for i, e := range index {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !paths.match(e.Path) {
+			continue
+		}
+		if i != next {
+			if err := r.Seek(e); err != nil {
+				return err
+			}
 		}
+		next = i + 1
+		rec, err := r.Next()
+		if err != nil {
+			return err
+		}
+		if rec.Metadata.Path != e.Path {
+			return fmt.Errorf("%q: index mismatch: found %q", e.Path,
+				rec.Metadata.Path)
+		}
+		if err = apply(r, i, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restorer applies the records of a chain of increments to destDir.  Its
+// record method may be called concurrently for unrelated paths.
+type restorer struct {
+	dest    destination
+	paths   *pathRewriter
+	policy  conflictPolicy
+	pending *pendingMetadata
+
+	// mu protects the maps below.
+	mu sync.Mutex
+
+	// written holds the state of the paths restored so far, against
+	// which conflicts and patch bases are checked.
+	written map[string]fileState
+
+	// skipped holds the existing paths left alone by conflictSkip.
+	skipped map[string]struct{}
+
+	// targets holds the backed up targets of the symlinks restored with
+	// a rewritten target, which later deltas apply to.
+	targets map[string]string
+
+	// journal records the progress of the restore when it is not nil.
+	journal *journal
+
+	// rebuild returns the contents of an archive path as of a level.
+	// Hard links whose target is not restored are given those.
+	rebuild func(path string, level uint16) (*os.File, error)
+}
+
+func newRestorer(destDir string, paths *pathRewriter, policy conflictPolicy) *restorer {
+	return &restorer{
+		dest:    destination{root: destDir},
+		paths:   paths,
+		policy:  policy,
+		pending: newPendingMetadata(),
+		written: make(map[string]fileState),
+		skipped: make(map[string]struct{}),
+		targets: make(map[string]string),
 	}
+}
 
-	if level < 0 || level > maxLevel {
-		level = maxLevel
+func (rs *restorer) record(r *archive.Reader, i int, rec *archive.Record) error {
+	// Paths are checked before they are rewritten, which would clean
+	// away their ".." components.
+	if err := checkPath(rec.Metadata.Path); err != nil {
+		return err
+	}
+	path, ok := rs.paths.rewrite(rec.Metadata.Path)
+	if !ok {
+		return nil
+	}
+	if rs.journal == nil {
+		return rs.apply(r, rec, path)
 	}
 
-	log.Printf("Restoring to level %d...", level)
-	startTime := time.Now()
-	for _, inst := range insts {
-		if inst.Timestamp != snapID {
-			log.Printf("skipping %s", inst.Filename)
-			continue
+	key := journalKey{level: r.Header.Increment, index: i}
+	if rs.journal.completed(key) {
+		return rs.replay(rec, path)
+	}
+	if rec.Kind == archive.KindChange || r.Header.Version < archive.Version2 {
+		// A basis left behind is that of an earlier attempt at this
+		// record whose begin line was lost.
+		if err := rs.rollback(path); err != nil {
+			return err
 		}
-		if inst.Increment > uint16(level) {
-			break
+	}
+	if err := rs.journal.begin(key, path); err != nil {
+		return err
+	}
+	if err := rs.apply(r, rec, path); err != nil {
+		return err
+	}
+	bases, err := rs.journal.finish(key, rs.outcome(path),
+		rec.Kind != archive.KindDelete)
+	if err != nil {
+		return err
+	}
+	for _, path := range bases {
+		rs.removeBasis(path)
+	}
+	return nil
+}
+
+// endLevel removes the bases kept for the records of level once their
+// completion is synced and records that the level was applied.
+func (rs *restorer) endLevel(level uint16) error {
+	bases, err := rs.journal.sync()
+	if err != nil {
+		return err
+	}
+	for _, path := range bases {
+		rs.removeBasis(path)
+	}
+	return rs.journal.endLevel(level)
+}
+
+// apply restores rec to the rewritten archive path.
+func (rs *restorer) apply(r *archive.Reader, rec *archive.Record, path string) error {
+	rs.mu.Lock()
+	_, skipped := rs.skipped[filepath.Join(rs.dest.root, path)]
+	rs.mu.Unlock()
+	if skipped {
+		return nil
+	}
+
+	p, err := rs.dest.open(path, rec.Kind != archive.KindDelete)
+	if err != nil {
+		if rec.Kind == archive.KindDelete && os.IsNotExist(err) {
+			return nil
 		}
-		//isLastLevel := inst.Instance == level
+		return err
+	}
+	defer p.Close()
 
-		log.Printf("----------  APPLYING LEVEL %d  -----------", inst.Increment)
-		log.Printf("file: %q", inst.Filename)
-		dataFile, err := os.Open(inst.Filename)
-		if err != nil {
+	var mode os.FileMode
+	if rec.Kind != archive.KindDelete {
+		mode = os.FileMode(rec.Metadata.Attribs.Mode)
+	}
+	existing, conflict, err := rs.conflict(p, mode)
+	if err != nil {
+		return err
+	}
+	if conflict {
+		skip, err := rs.resolveConflict(p, existing)
+		if err != nil || skip {
 			return err
 		}
-		header, err := stream.ReadHeader(dataFile)
-		if err != nil {
-			dataFile.Close()
+	}
+
+	// The metadata of a directory or the flags of a path replaced by this
+	// record must not be applied to the new path.
+	rs.pending.remove(path)
+
+	if rec.Kind == archive.KindDelete {
+		log.Printf("%q: deleting file", p.path)
+		rs.mu.Lock()
+		delete(rs.written, p.path)
+		delete(rs.targets, p.path)
+		rs.mu.Unlock()
+		err = p.remove()
+		if err != nil && !os.IsNotExist(err) {
 			return err
 		}
-		symKey, err := stream.Decapsulate(header, secretKey)
-		if err != nil {
-			dataFile.Close()
+		return nil
+	}
+
+	delta := rec.Kind == archive.KindChange
+	if r.Header.Version < archive.Version2 {
+		// Version 1 snapshots do not record whether the data is a
+		// delta.
+		rs.mu.Lock()
+		_, delta = rs.written[p.path]
+		rs.mu.Unlock()
+	}
+	if _, isLink := rec.Metadata.Link(); delta && !isLink &&
+		(mode.IsRegular() || isSymlink(mode)) {
+		if err = rs.checkBasis(p); err != nil {
 			return err
 		}
+	}
 
-		pipeR, pipeW := io.Pipe()
-		eg, ctx := errgroup.WithContext(ctx)
-		eg.Go(func() error {
-			defer dataFile.Close()
-			err = stream.Decrypt(pipeW, dataFile, header.Bytes, symKey)
-			if err != nil {
-				pipeW.Close()
-				return err
-			}
-			return pipeW.Close()
-		})
-		dataFileGZ, err := gzip.NewReader(pipeR)
+	if err = rs.restoreRecord(r, rec, path, p, delta); err != nil {
+		return err
+	}
+	return rs.markWritten(p)
+}
+
+// restoreRecord restores rec to p, the destination path of the rewritten
+// archive path relPath.
+func (rs *restorer) restoreRecord(r *archive.Reader, rec *archive.Record, relPath string, p *destPath, delta bool) error {
+	var err error
+	b := new(bytes.Buffer)
+	path := p.path
+	attrib := rec.Metadata.Attribs
+	dataLen := rec.DataLen
+
+	flags, err := rec.Metadata.Flags()
+	if err != nil {
+		return err
+	}
+	rs.pending.setFlags(relPath, flags)
+
+	fileMode := os.FileMode(attrib.Mode)
+	if !isSymlink(fileMode) {
+		rs.mu.Lock()
+		delete(rs.targets, path)
+		rs.mu.Unlock()
+	}
+	switch {
+	case isSocket(fileMode):
+		// Sockets are created by the programs listening on them and
+		// are not backed up.
+		log.Printf("%q: skipping socket", path)
+		return nil
+	case isDevice(fileMode):
+		var nodeType uint32 = syscall.S_IFBLK
+		if isCharDevice(fileMode) {
+			nodeType = syscall.S_IFCHR
+		}
+		if err = p.remove(); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.Printf("%q: new node %d:%d", path, unix.Major(attrib.RDev),
+			unix.Minor(attrib.RDev))
+		err = p.mknod(nodeType|0o0600, int(attrib.RDev))
 		if err != nil {
-			pipeR.Close()
-			pipeW.Close()
+			if errors.Is(err, syscall.EPERM) {
+				// Creating device nodes requires CAP_MKNOD.
+				log.Printf("%q: skipping device %d:%d: %v (restore "+
+					"as root to create device nodes)", path,
+					unix.Major(attrib.RDev), unix.Minor(attrib.RDev), err)
+				return nil
+			}
 			return err
 		}
-
-		b := new(bytes.Buffer)
-		if _, err := io.CopyN(b, dataFileGZ, 3); err != nil {
-			dataFileGZ.Close()
-			pipeR.Close()
+		if err = p.lchown(int(attrib.UID), int(attrib.GID)); err != nil {
+			log.Printf("%v", err)
+		}
+		// Chown clears the setuid and setgid bits, so the mode is set
+		// after it.
+		if err = p.chmod(fileMode); err != nil {
+			p.remove()
+			return err
+		}
+		restoreXattrs(p, &rec.Metadata)
+		if err = p.lchtimes(attrib.MTim); err != nil {
+			log.Printf("%v", err)
+		}
+		return nil
+	case isNamedPipe(fileMode):
+		if err = p.remove(); err != nil && !os.IsNotExist(err) {
 			return err
 		}
-		hostLen := int64(b.Bytes()[2])
-		b.Reset()
-		b.Grow(1024 * 1024)
-		if _, err := io.CopyN(b, dataFileGZ, hostLen+8+2); err != nil {
-			dataFileGZ.Close()
-			pipeR.Close()
+		err = p.mknod(syscall.S_IFIFO|0o0600, 0)
+		if err != nil {
 			return err
 		}
-		buf := b.Bytes()
-		if snapID != time.Unix(int64(binary.LittleEndian.Uint64(buf[hostLen:hostLen+8])), 0) {
-			dataFileGZ.Close()
-			pipeR.Close()
-			return nil
+		if err = p.lchown(int(attrib.UID), int(attrib.GID)); err != nil {
+			log.Printf("%v", err)
 		}
-		tmpInc := binary.LittleEndian.Uint16(buf[hostLen+8 : hostLen+8+2])
-		if tmpInc != inst.Increment {
-			dataFileGZ.Close()
-			pipeR.Close()
-			return fmt.Errorf("%q inconsistency: got:%d expected:%d",
-				inst.Filename, tmpInc, inst.Increment)
-		}
-		for {
-			if ctx.Err() != nil {
-				dataFileGZ.Close()
-				pipeR.Close()
-				return ctx.Err()
+		// Chown clears the setuid and setgid bits, so the mode is set
+		// after it.
+		if err = p.chmod(fileMode); err != nil {
+			p.remove()
+			return err
+		}
+		restoreXattrs(p, &rec.Metadata)
+		if err = p.lchtimes(attrib.MTim); err != nil {
+			log.Printf("%v", err)
+		}
+
+		return nil
+	case isDir(fileMode):
+		// Restoring children would clobber the mode, owner and mtime,
+		// so they are applied once everything has been restored.
+		err = p.mkdir(0o0700)
+		if os.IsExist(err) {
+			// Anything but a directory, such as a symlink restored
+			// by an earlier level, is replaced.
+			st, serr := p.lstat()
+			if serr != nil {
+				return serr
 			}
-			b.Reset()
-			if _, err := io.CopyN(b, dataFileGZ, 2); err != nil {
-				if errors.Is(err, io.EOF) {
-					break
+			err = nil
+			if !isDir(statMode(st.Mode)) {
+				if err = p.remove(); err == nil {
+					err = p.mkdir(0o0700)
 				}
-				dataFileGZ.Close()
-				pipeR.Close()
-				return err
-			}
-			pathLen := binary.LittleEndian.Uint16(b.Bytes()[0:2])
-			b.Reset()
-			if _, err := io.CopyN(b, dataFileGZ, int64(pathLen)); err != nil {
-				dataFileGZ.Close()
-				pipeR.Close()
-				return err
 			}
-			path := filepath.Join(destDir, b.String())
-			extract := true
-			if fileRegexp != nil && !fileRegexp.MatchString(b.String()) {
-				extract = false
-			}
-			b.Reset()
-			if _, err := io.CopyN(b, dataFileGZ, 36); err != nil {
-				dataFileGZ.Close()
-				pipeR.Close()
-				return err
-			}
-			var attrib FileAttributes
-			if err = attrib.Deserialize(b.Bytes()); err != nil {
-				dataFileGZ.Close()
-				pipeR.Close()
+		}
+		if err != nil {
+			return err
+		}
+		restoreXattrs(p, &rec.Metadata)
+		rs.pending.setDir(relPath, attrib)
+		return nil
+	case isSymlink(fileMode):
+		if _, err = io.CopyN(b, rec.Data, dataLen); err != nil {
+			return err
+		}
+		if !delta {
+			log.Printf("%q: new symlink -> %s", path, b.Bytes())
+			if err = rs.symlink(p, b.String()); err != nil {
 				return err
 			}
-			b.Reset()
-
-			if _, err := io.CopyN(b, dataFileGZ, 8); err != nil {
-				dataFileGZ.Close()
-				pipeR.Close()
+		} else {
+			log.Printf("%q: patching [symlink]", path)
+			st, err := p.lstat()
+			if err != nil {
 				return err
 			}
-			dataLen := binary.LittleEndian.Uint64(b.Bytes()[0:8])
-			b.Reset()
 
-			if attrib.IsEmpty() {
-				log.Printf("%q: deleting file", path)
-				err = os.Remove(path)
-				if err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
-					return err
-				}
-				continue
-			}
-
-			fileMode := os.FileMode(attrib.Mode)
-			switch {
-			case isSocket(fileMode):
-				fallthrough
-			case isCharDevice(fileMode):
-				fallthrough
-			case isDevice(fileMode):
-				if !extract {
-					continue
-				}
-				log.Printf("%q: unsupported file", path)
-				continue
-			case isNamedPipe(fileMode):
-				if !extract {
-					continue
-				}
-				err = syscall.Mkfifo(path, 0o0600)
-				if err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
-					return err
-				}
-				if err = os.Chmod(path, fileMode.Perm()); err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
-					os.Remove(path)
-					return err
-				}
-				if err = os.Chown(path, int(attrib.UID), int(attrib.GID)); err != nil {
-					log.Printf("%v", err)
-				}
-
-				continue
-			case isDir(fileMode):
-				if !extract {
-					continue
-				}
-				err = os.MkdirAll(path, fileMode)
-				if err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
-					return err
-				}
-				continue
-			case isSymlink(fileMode):
-				if _, err = io.CopyN(b, dataFileGZ, int64(dataLen)); err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
-					return err
-				}
-				if !extract {
-					continue
-				}
-				if st, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
-					log.Printf("%q: new symlink -> %s", path, b.Bytes())
-					err = os.Symlink(b.String(), path)
+			reader := bytes.NewReader(b.Bytes())
+			target := new(bytes.Buffer)
+			if isSymlink(statMode(st.Mode)) {
+				rs.mu.Lock()
+				currentDelta, ok := rs.targets[path]
+				rs.mu.Unlock()
+				if !ok {
+					currentDelta, err = p.readlink()
 					if err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
-						return err
-					}
-				} else {
-					log.Printf("%q: patching [symlink]", path)
-
-					reader := bytes.NewReader(b.Bytes())
-					target := new(bytes.Buffer)
-					if isSymlink(st.Mode()) {
-						currentDelta, err := os.Readlink(path)
-						if err != nil {
-							dataFileGZ.Close()
-							pipeR.Close()
-							return err
-						}
-						basis := bytes.NewReader([]byte(currentDelta))
-						if err = rsync.Patch(reader, basis, target); err != nil {
-							dataFileGZ.Close()
-							pipeR.Close()
-							return err
-						}
-					} else {
-						basis, err := os.Open(path)
-						if err != nil {
-							dataFileGZ.Close()
-							pipeR.Close()
-							return err
-						}
-						if err = rsync.Patch(reader, basis, target); err != nil {
-							basis.Close()
-							dataFileGZ.Close()
-							pipeR.Close()
-							return err
-						}
-						basis.Close()
-					}
-					if err = os.Remove(path); err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
 						return err
 					}
-					if err = os.Symlink(target.String(), path); err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
-						return err
-					}
-				}
-			default:
-				if !extract {
-					if _, err = io.CopyN(ioutil.Discard, dataFileGZ, int64(dataLen)); err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
-						return err
-					}
-					continue
 				}
-				if fileRegexp != nil {
-					fileDir := filepath.Dir(path)
-					if _, err := os.Stat(fileDir); err != nil {
-						if !os.IsNotExist(err) {
-							dataFileGZ.Close()
-							pipeR.Close()
-							return err
-						}
-						err = os.MkdirAll(fileDir, 0o0755)
-						if err != nil {
-							dataFileGZ.Close()
-							pipeR.Close()
-							return err
-						}
-					}
+				basis := bytes.NewReader([]byte(currentDelta))
+				if err = rsync.Patch(reader, basis, target); err != nil {
+					return err
 				}
-
-				tmpFile, err := os.OpenFile(path+".partial", os.O_CREATE|os.O_WRONLY, 0600)
+			} else {
+				basis, err := p.openFile("", os.O_RDONLY, 0)
 				if err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
 					return err
 				}
-				if _, err = os.Stat(path); errors.Is(err, os.ErrNotExist) {
-					log.Printf("%q: new file", path)
-					if _, err = io.CopyN(tmpFile, dataFileGZ, int64(dataLen)); err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
-						tmpFile.Close()
-						os.Remove(tmpFile.Name())
-						return err
-					}
-				} else {
-					log.Printf("%q: patching", path)
-					buf := new(bytes.Buffer)
-					buf.Grow(int(dataLen))
-					if _, err = io.CopyN(buf, dataFileGZ, int64(dataLen)); err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
-						tmpFile.Close()
-						os.Remove(tmpFile.Name())
-						return err
-					}
-
-					basis, err := os.Open(path)
-					if err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
-						tmpFile.Close()
-						os.Remove(tmpFile.Name())
-						return err
-					}
-
-					reader := bytes.NewReader(buf.Bytes())
-					if err = rsync.Patch(reader, basis, tmpFile); err != nil {
-						basis.Close()
-						dataFileGZ.Close()
-						pipeR.Close()
-						tmpFile.Close()
-						os.Remove(tmpFile.Name())
-						return err
-					}
+				if err = rsync.Patch(reader, basis, target); err != nil {
 					basis.Close()
-				}
-				if err = tmpFile.Close(); err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
-					os.Remove(tmpFile.Name())
 					return err
 				}
-				if err = os.Rename(tmpFile.Name(), path); err != nil {
-					dataFileGZ.Close()
-					pipeR.Close()
-					os.Remove(tmpFile.Name())
+				basis.Close()
+			}
+			if err = rs.keepBasis(p); err != nil {
+				return err
+			}
+			if err = p.remove(); err != nil {
+				return err
+			}
+			if err = rs.symlink(p, target.String()); err != nil {
+				return err
+			}
+		}
+		if err = p.lchown(int(attrib.UID), int(attrib.GID)); err != nil {
+			log.Printf("%v", err)
+		}
+		restoreXattrs(p, &rec.Metadata)
+		if err = p.lchtimes(attrib.MTim); err != nil {
+			log.Printf("%v", err)
+		}
+	default:
+		extents, sparse, err := rec.Metadata.Extents()
+		if err != nil {
+			return err
+		}
+		data := rec.Data
+		if target, ok := rec.Metadata.Link(); ok {
+			linked, err := rs.restoreLink(p, target)
+			if err != nil || linked {
+				return err
+			}
+			// The target is not restored, so the contents are
+			// rebuilt from its records and written to p.
+			log.Printf("%q: hard link target %q not restored, "+
+				"restoring its contents", path, target)
+			f, err := rs.rebuild(rec.Metadata.Path, r.Header.Increment)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			st, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			data, dataLen, delta = f, st.Size(), false
+			if sparse {
+				data, dataLen = archive.ExtentsReader(f, extents)
+			}
+		}
+		tmpFile, err := p.openFile(".partial", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		// The partial file is only ever removed relative to the parent.
+		removeTmp := func() {
+			unix.Unlinkat(p.dir, p.name+".partial", 0)
+		}
+		if !delta {
+			log.Printf("%q: new file", path)
+			if sparse {
+				err = writeExtents(tmpFile, data, extents, attrib.Size)
+			} else {
+				_, err = io.CopyN(tmpFile, data, dataLen)
+			}
+			if err != nil {
+				tmpFile.Close()
+				removeTmp()
+				return err
+			}
+		} else {
+			log.Printf("%q: patching", path)
+			basis, err := p.openFile("", os.O_RDONLY, 0)
+			if err != nil {
+				tmpFile.Close()
+				removeTmp()
+				return err
+			}
+
+			// The delta is streamed from the record rather than
+			// held in memory, whatever the size of the file.
+			reader := io.LimitReader(rec.Data, dataLen)
+			var out io.Writer = tmpFile
+			var hw *holeWriter
+			if sparse {
+				hw = newHoleWriter(tmpFile, extents)
+				out = hw
+			}
+			if err = rsync.Patch(reader, basis, out); err != nil {
+				basis.Close()
+				tmpFile.Close()
+				removeTmp()
+				return err
+			}
+			basis.Close()
+			if hw != nil {
+				if err = hw.finish(); err != nil {
+					tmpFile.Close()
+					removeTmp()
 					return err
 				}
-				if !isSymlink(fileMode) {
-					if err = os.Chmod(path, fileMode.Perm()); err != nil {
-						dataFileGZ.Close()
-						pipeR.Close()
-						os.Remove(path)
-						return err
-					}
-					if err = os.Chown(path, int(attrib.UID), int(attrib.GID)); err != nil {
-						log.Printf("%v", err)
-					}
-				}
 			}
 		}
-		if err := eg.Wait(); err != nil {
-			dataFileGZ.Close()
-			pipeR.Close()
+		if err = tmpFile.Close(); err != nil {
+			removeTmp()
 			return err
 		}
-		if err = dataFileGZ.Close(); err != nil {
-			pipeR.Close()
+		if delta {
+			if err = rs.keepBasis(p); err != nil {
+				removeTmp()
+				return err
+			}
+		}
+		if err = p.rename(".partial"); err != nil {
+			removeTmp()
+			return err
+		}
+		if err = p.lchown(int(attrib.UID), int(attrib.GID)); err != nil {
+			log.Printf("%v", err)
+		}
+		// Chown clears the setuid and setgid bits, so the mode is set
+		// after it.
+		if err = p.chmod(fileMode); err != nil {
+			p.remove()
 			return err
 		}
-		pipeR.Close()
+		restoreXattrs(p, &rec.Metadata)
+		if err = p.lchtimes(attrib.MTim); err != nil {
+			log.Printf("%v", err)
+		}
 	}
-	log.Printf("completed in %v", time.Since(startTime))
 	return nil
 }
+
+// symlink creates p as a symlink to target, rewritten when it falls under a
+// path mapping.
+func (rs *restorer) symlink(p *destPath, target string) error {
+	rewritten := rs.paths.rewriteTarget(target, rs.dest.root)
+	if rewritten == target {
+		rs.mu.Lock()
+		delete(rs.targets, p.path)
+		rs.mu.Unlock()
+		return p.symlink(target)
+	}
+	log.Printf("%q: rewriting symlink target %s -> %s", p.path, target,
+		rewritten)
+	if err := p.symlink(rewritten); err != nil {
+		return err
+	}
+	rs.mu.Lock()
+	rs.targets[p.path] = target
+	rs.mu.Unlock()
+	return nil
+}
+
+// restoreLink links p to the target of a hard link and reports whether it
+// did.  Only targets written by this restore are linked to: linking to an
+// existing file or to nothing would give p contents that were never backed
+// up, or none at all.
+func (rs *restorer) restoreLink(p *destPath, target string) (bool, error) {
+	if err := checkPath(target); err != nil {
+		return false, err
+	}
+	mapped, ok := rs.paths.mapPath(target)
+	if !ok {
+		// The link target lies outside of the stripped prefix.
+		return false, nil
+	}
+	t, err := rs.dest.open(mapped, false)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// The directory of the link target was not restored.
+			return false, nil
+		}
+		return false, err
+	}
+	defer t.Close()
+	rs.mu.Lock()
+	_, written := rs.written[t.path]
+	rs.mu.Unlock()
+	if !written {
+		return false, nil
+	}
+	log.Printf("%q: hard link to %q", p.path, t.path)
+	if err = p.remove(); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, p.link(t)
+}
+
+// pendingMetadata holds the metadata applied once every increment has been
+// restored, keyed by rewritten archive path.
+type pendingMetadata struct {
+	mu    sync.Mutex
+	dirs  map[string]archive.FileAttributes
+	flags map[string]uint32
+}
+
+func newPendingMetadata() *pendingMetadata {
+	return &pendingMetadata{
+		dirs:  make(map[string]archive.FileAttributes),
+		flags: make(map[string]uint32),
+	}
+}
+
+func (p *pendingMetadata) setDir(path string, attrib archive.FileAttributes) {
+	p.mu.Lock()
+	p.dirs[path] = attrib
+	p.mu.Unlock()
+}
+
+func (p *pendingMetadata) setFlags(path string, flags uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if flags == 0 {
+		delete(p.flags, path)
+		return
+	}
+	p.flags[path] = flags
+}
+
+func (p *pendingMetadata) remove(path string) {
+	p.mu.Lock()
+	delete(p.dirs, path)
+	delete(p.flags, path)
+	p.mu.Unlock()
+}
+
+// apply sets the directory metadata, children first, followed by the inode
+// flags since flags such as immutable prevent any further change.
+func (p *pendingMetadata) apply(dest *destination) {
+	dirs := make([]string, 0, len(p.dirs))
+	for path := range p.dirs {
+		dirs = append(dirs, path)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, path := range dirs {
+		if err := p.applyDir(dest, path, p.dirs[path]); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+
+	for path, flags := range p.flags {
+		dp, err := dest.open(path, false)
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+		f, err := dp.openFile("", os.O_RDONLY|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			log.Printf("%q: set flags: %v", dp.path, err)
+			dp.Close()
+			continue
+		}
+		restoreFlags(f, flags)
+		f.Close()
+		dp.Close()
+	}
+}
+
+func (p *pendingMetadata) applyDir(dest *destination, path string, attrib archive.FileAttributes) error {
+	dp, err := dest.open(path, false)
+	if err != nil {
+		return err
+	}
+	defer dp.Close()
+	// The directory is opened without following symlinks so that its
+	// metadata is never applied outside of the destination.
+	d, err := dp.openFile("", os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	fileMode := os.FileMode(attrib.Mode)
+	if err = d.Chown(int(attrib.UID), int(attrib.GID)); err != nil {
+		log.Printf("%v", err)
+	}
+	// Chown may clear the setuid and setgid bits, so the mode is set
+	// after it.
+	err = d.Chmod(fileMode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid |
+		os.ModeSticky))
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	return dp.lchtimes(attrib.MTim)
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"multus/archive"
+)
+
+func TestRestoreSpecialModes(t *testing.T) {
+	tb := newTestBackup(t)
+	tb.write("setuid", []byte("setuid\n"), 0o755|os.ModeSetuid)
+	tb.write("setgid", []byte("setgid\n"), 0o750|os.ModeSetgid)
+	tb.write("changed", []byte("first\n"), 0o700)
+	if err := syscall.Mkfifo(tb.path("fifo"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(tb.path("fifo"), 0o640|os.ModeSetgid|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+	tb.backup()
+	tb.write("changed", []byte("second\n"), 0o755|os.ModeSetuid|os.ModeSetgid)
+	tb.backup()
+
+	dest := tb.restore(-1, restoreOptions{verify: true})
+	for _, name := range []string{"setuid", "setgid", "changed", "fifo"} {
+		want, err := os.Lstat(tb.path(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.Lstat(dest + tb.path(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Mode() != want.Mode() {
+			t.Errorf("%s: restored with mode %v, want %v", name,
+				got.Mode(), want.Mode())
+		}
+	}
+}
+
+func TestRestoreCorrupt(t *testing.T) {
+	tb := newTestBackup(t)
+	data := make([]byte, 3<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	tb.write("file", data[:100], 0o644)
+	tb.backup()
+	// Enough incompressible data for several blocks.
+	tb.write("file", data, 0o644)
+	tb.backup()
+	incs, err := filepath.Glob(filepath.Join(tb.cfg.BackupPath, "*.1.gz.enc"))
+	if err != nil || len(incs) != 1 {
+		t.Fatalf("increments %v: %v", incs, err)
+	}
+	b, err := os.ReadFile(incs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		tamper func([]byte) []byte
+		want   error
+	}{
+		{"flipped byte", func(b []byte) []byte {
+			b[len(b)/2] ^= 1
+			return b
+		}, archive.ErrCorrupt},
+		{"truncated", func(b []byte) []byte {
+			return b[:len(b)-100]
+		}, archive.ErrTruncated},
+	}
+	for _, tt := range tests {
+		tampered := tt.tamper(append([]byte(nil), b...))
+		if err = os.WriteFile(incs[0], tampered, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// Nothing is applied before every increment was verified.
+		dest := filepath.Join(t.TempDir(), "dest")
+		err = restore(context.Background(), tb.secretKey, tb.cfg.BackupPath,
+			dest, nil, -1, restoreOptions{})
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: restore: %v", tt.name, err)
+		}
+		if _, err = os.Lstat(dest); !os.IsNotExist(err) {
+			t.Errorf("%s: destination touched: %v", tt.name, err)
+		}
+	}
+}
+
+func TestSelectCorrupt(t *testing.T) {
+	tb := newTestBackup(t)
+	data := make([]byte, 3<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	tb.write("file", data[:100], 0o644)
+	tb.write("other", []byte("first\n"), 0o644)
+	tb.backup()
+	tb.write("file", data, 0o644)
+	tb.write("other", []byte("second\n"), 0o644)
+	tb.backup()
+	incs, err := filepath.Glob(filepath.Join(tb.cfg.BackupPath, "*.1.gz.enc"))
+	if err != nil || len(incs) != 1 {
+		t.Fatalf("increments %v: %v", incs, err)
+	}
+	b, err := os.ReadFile(incs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The selected record is in another block than the flipped byte, so
+	// only the verification of the whole increment finds it.
+	b[len(b)/2] ^= 1
+	if err = os.WriteFile(incs[0], b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	filter := new(pathFilter)
+	if err = filter.addInclude(tb.path("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	dest := filepath.Join(t.TempDir(), "dest")
+	err = restore(ctx, tb.secretKey, tb.cfg.BackupPath, dest, filter, -1,
+		restoreOptions{})
+	if !errors.Is(err, archive.ErrCorrupt) {
+		t.Errorf("restore: %v", err)
+	}
+	err = restoreTar(ctx, tb.secretKey, tb.cfg.BackupPath, io.Discard, filter,
+		-1, restoreOptions{})
+	if !errors.Is(err, archive.ErrCorrupt) {
+		t.Errorf("tar: %v", err)
+	}
+	if err = cat(ctx, tb.secretKey, incs[0], filter); !errors.Is(err, archive.ErrCorrupt) {
+		t.Errorf("cat: %v", err)
+	}
+}
+
+func TestRestoreLinkSelected(t *testing.T) {
+	tb := newTestBackup(t)
+	tb.write("a/target", []byte("first\n"), 0o640)
+	if err := os.Mkdir(tb.path("b"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// The first path walked holds the contents, the others link to it.
+	if err := os.Link(tb.path("a/target"), tb.path("b/link")); err != nil {
+		t.Fatal(err)
+	}
+	tb.backup()
+	tb.write("a/target", []byte("second, patched by level 1\n"), 0o640)
+	tb.backup()
+
+	// Only the link is selected.
+	filter := new(pathFilter)
+	if err := filter.addInclude(tb.path("b")); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for level, want := range []string{"first\n", "second, patched by level 1\n"} {
+		dest := filepath.Join(t.TempDir(), "dest")
+		err := restore(ctx, tb.secretKey, tb.cfg.BackupPath, dest, filter,
+			int32(level), restoreOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(dest + tb.path("b/link"))
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		if string(got) != want {
+			t.Errorf("level %d: link holds %q, want %q", level, got, want)
+		}
+		fi, err := os.Stat(dest + tb.path("b/link"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != 0o640 {
+			t.Errorf("level %d: link restored with mode %v", level, fi.Mode())
+		}
+		if _, err = os.Lstat(dest + tb.path("a")); !os.IsNotExist(err) {
+			t.Errorf("level %d: target restored: %v", level, err)
+		}
+
+		var buf bytes.Buffer
+		err = restoreTar(ctx, tb.secretKey, tb.cfg.BackupPath, &buf, filter,
+			int32(level), restoreOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(&buf)
+		found := false
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Name != tarName(tb.path("b/link")) {
+				continue
+			}
+			found = true
+			got, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag != tar.TypeReg || string(got) != want {
+				t.Errorf("level %d: tar holds the link as %c %q", level,
+					hdr.Typeflag, got)
+			}
+		}
+		if !found {
+			t.Errorf("level %d: link not written to the tar stream", level)
+		}
+	}
+}
+
+func TestRestoreLargeDelta(t *testing.T) {
+	tb := newTestBackup(t)
+	data := make([]byte, memoryLimit+memoryLimit/2)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	tb.write("large", data, 0o644)
+	tb.write("small", []byte("small\n"), 0o644)
+	tb.backup()
+	copy(data[memoryLimit/3:], "level 1")
+	data = append(data, "appended by level 1"...)
+	tb.write("large", data, 0o644)
+	tb.write("small", []byte("small, changed\n"), 0o644)
+	tb.backup()
+	level1 := append([]byte(nil), data...)
+	copy(data[memoryLimit:], "level 2")
+	tb.write("large", data, 0o644)
+	tb.backup()
+
+	// The deltas are larger than what the pipeline reads ahead, so they
+	// are streamed into the patch.
+	incs, err := filepath.Glob(filepath.Join(tb.cfg.BackupPath, "*.1.gz.enc"))
+	if err != nil || len(incs) != 1 {
+		t.Fatalf("increments %v: %v", incs, err)
+	}
+	r, err := archive.Open(incs[0], tb.secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		rec, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Metadata.Path != tb.path("large") {
+			continue
+		}
+		if rec.Kind != archive.KindChange || rec.DataLen <= memoryLimit {
+			t.Fatalf("large file written as %v of %d bytes", rec.Kind,
+				rec.DataLen)
+		}
+		break
+	}
+	r.Close()
+
+	for _, jobs := range []int{1, 4} {
+		tb.diff(tb.restore(-1, restoreOptions{jobs: jobs}))
+		dest := tb.restore(1, restoreOptions{jobs: jobs})
+		got, err := os.ReadFile(dest + tb.path("large"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, level1) {
+			t.Errorf("%d jobs: level 1 restored with different contents", jobs)
+		}
+		if _, err = os.Stat(dest + tb.path("large.basis")); !os.IsNotExist(err) {
+			t.Errorf("%d jobs: basis left behind: %v", jobs, err)
+		}
+	}
+}
+
+func TestRestoreDevices(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating device nodes requires root")
+	}
+	tb := newTestBackup(t)
+	// Numbers that do not fit the old 8 bit encoding, within the 12 bit
+	// majors of the kernel.
+	devices := map[string]uint32{
+		"char":  unix.S_IFCHR,
+		"block": unix.S_IFBLK,
+	}
+	rdev := unix.Mkdev(0x234, 0x12345)
+	for name, mode := range devices {
+		if err := unix.Mknod(tb.path(name), mode|0o640, int(rdev)); err != nil {
+			t.Skip(err)
+		}
+	}
+	tb.backup()
+
+	dest := tb.restore(-1, restoreOptions{verify: true})
+	for name := range devices {
+		var st unix.Stat_t
+		if err := unix.Lstat(dest+tb.path(name), &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Rdev != rdev {
+			t.Errorf("%s: restored as %d:%d, want %d:%d", name,
+				unix.Major(st.Rdev), unix.Minor(st.Rdev),
+				unix.Major(rdev), unix.Minor(rdev))
+		}
+	}
+}
+
+// dataExtents returns the data extents of path, as found by SEEK_DATA and
+// SEEK_HOLE.
+func dataExtents(t *testing.T, path string) []archive.Extent {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd := int(f.Fd())
+	var extents []archive.Extent
+	var offset int64
+	for offset < fi.Size() {
+		data, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		extents = append(extents, archive.Extent{Offset: data,
+			Length: hole - data})
+		offset = hole
+	}
+	return extents
+}
+
+func TestRestoreSparse(t *testing.T) {
+	const mib = 1 << 20
+	tb := newTestBackup(t)
+	tb.write("sparse", nil, 0o644)
+	f, err := os.OpenFile(tb.path("sparse"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 64<<10)
+	if _, err = rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	// A leading hole, two data extents and a trailing hole.
+	for _, off := range []int64{mib, 4 * mib} {
+		if _, err = f.WriteAt(data, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = f.Truncate(8 * mib); err != nil {
+		t.Fatal(err)
+	}
+	want := dataExtents(t, tb.path("sparse"))
+	if len(want) != 2 {
+		f.Close()
+		t.Skipf("file system does not report holes: %v", want)
+	}
+	tb.backup()
+
+	// Level 1 patches the second extent, which goes through holeWriter
+	// rather than writeExtents.
+	if _, err = f.WriteAt([]byte("level 1"), 4*mib+100); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tb.backup()
+
+	for level := int32(0); level <= 1; level++ {
+		dest := tb.restore(level, restoreOptions{})
+		path := dest + tb.path("sparse")
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != 8*mib {
+			t.Errorf("level %d: size %d, want %d", level, fi.Size(),
+				8*mib)
+		}
+		got := dataExtents(t, path)
+		if len(got) != len(want) {
+			t.Fatalf("level %d: extents %v, want %v", level, got,
+				want)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("level %d: extents %v, want %v", level,
+					got, want)
+				break
+			}
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched := level == 1
+		if bytes.Contains(b, []byte("level 1")) != patched {
+			t.Errorf("level %d: patch applied: %v, want %v", level,
+				!patched, patched)
+		}
+	}
+	tb.diff(tb.restore(1, restoreOptions{}))
+}
+
+func TestRestoreDirMetadata(t *testing.T) {
+	tb := newTestBackup(t)
+	tb.write("d/sub/file", []byte("file\n"), 0o644)
+	tb.write("d/other", []byte("other\n"), 0o644)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	modes := map[string]os.FileMode{"d": 0o750, "d/sub": 0o500}
+	for name, mode := range modes {
+		if err := os.Chmod(tb.path(name), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(tb.path(name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { os.Chmod(tb.path("d/sub"), 0o755) })
+	tb.backup()
+
+	// The directories are restored with their metadata even though
+	// their contents, written afterwards, would change their mtime and
+	// d/sub is not writable.
+	dest := tb.restore(0, restoreOptions{})
+	t.Cleanup(func() { os.Chmod(dest+tb.path("d/sub"), 0o755) })
+	for name, mode := range modes {
+		fi, err := os.Stat(dest + tb.path(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != os.ModeDir|mode {
+			t.Errorf("%s: mode %v, want %v", name, fi.Mode(),
+				os.ModeDir|mode)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: mtime %v, want %v", name, fi.ModTime(), mtime)
+		}
+	}
+}
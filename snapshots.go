@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jrick/ss/stream"
+	"golang.org/x/term"
+	"multus/archive"
+)
+
+// snapshotOptions selects the snapshot, and the increments of it, that
+// commands operate on.
+type snapshotOptions struct {
+	// snapshot selects the snapshot: "latest", an index
+	// into the listing or an RFC3339 timestamp.  When empty, the only
+	// snapshot is used or the user is prompted.
+	snapshot string
+
+	// host limits the snapshots to those of a host.
+	host string
+
+	// at selects the state as of a point in time: the latest snapshot
+	// started before at and only the increments created up to at.
+	// Ignored when zero.
+	at time.Time
+}
+
+// snapshotID identifies a snapshot, which is a chain of increments.
+type snapshotID struct {
+	Hostname  string
+	Timestamp time.Time
+}
+
+func (s snapshotID) String() string {
+	return fmt.Sprintf("%s %s", s.Hostname, s.Timestamp.Format(time.RFC3339))
+}
+
+// snapshotIDs returns the snapshots of insts, which must be sorted, in
+// chronological order.
+func snapshotIDs(insts IncrementalFiles, host string) []snapshotID {
+	var snaps []snapshotID
+	for _, inst := range insts {
+		if host != "" && inst.Hostname != host {
+			continue
+		}
+		id := snapshotID{Hostname: inst.Hostname, Timestamp: inst.Timestamp}
+		if len(snaps) == 0 || snaps[len(snaps)-1] != id {
+			snaps = append(snaps, id)
+		}
+	}
+	return snaps
+}
+
+// selectSnapshot returns the snapshot selected by sel, which is "latest",
+// an index into snaps or an RFC3339 timestamp.
+func selectSnapshot(snaps []snapshotID, sel string) (snapshotID, error) {
+	if sel == "latest" {
+		return snaps[len(snaps)-1], nil
+	}
+	if u, err := strconv.ParseUint(sel, 10, 64); err == nil {
+		if u >= uint64(len(snaps)) {
+			return snapshotID{}, fmt.Errorf("invalid id '%d'", u)
+		}
+		return snaps[u], nil
+	}
+	ts, err := time.Parse(time.RFC3339, sel)
+	if err != nil {
+		return snapshotID{}, fmt.Errorf("invalid snapshot %q: expected "+
+			"latest, an id or an RFC3339 timestamp", sel)
+	}
+	var found []snapshotID
+	for _, snap := range snaps {
+		if snap.Timestamp.Equal(ts) {
+			found = append(found, snap)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return snapshotID{}, fmt.Errorf("no snapshot at %v", sel)
+	case 1:
+		return found[0], nil
+	default:
+		return snapshotID{}, fmt.Errorf("%d snapshots at %v, use --host",
+			len(found), sel)
+	}
+}
+
+// snapshotAt returns the latest of snaps started no later than at.  When
+// snaps hold the snapshots of several hosts, at is ambiguous unless only one
+// of them had started a snapshot by then.
+func snapshotAt(insts IncrementalFiles, snaps []snapshotID, at time.Time) (snapshotID, error) {
+	// found maps a host to its latest snapshot started by at.
+	found := make(map[string]*IncrementalFile)
+	for i, inst := range insts {
+		if inst.Increment != 0 || inst.Created.After(at) {
+			continue
+		}
+		for _, snap := range snaps {
+			if snap.Hostname == inst.Hostname &&
+				snap.Timestamp.Equal(inst.Timestamp) {
+				latest := found[inst.Hostname]
+				if latest == nil || !inst.Created.Before(latest.Created) {
+					found[inst.Hostname] = &insts[i]
+				}
+				break
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return snapshotID{}, fmt.Errorf("no snapshot created before %v",
+			at.Format(time.RFC3339))
+	case 1:
+		for _, inst := range found {
+			return snapshotID{Hostname: inst.Hostname,
+				Timestamp: inst.Timestamp}, nil
+		}
+	}
+	return snapshotID{}, fmt.Errorf("snapshots of %d hosts created before "+
+		"%v, use --host", len(found), at.Format(time.RFC3339))
+}
+
+// selectChain returns the snapshot selected by opts along with its
+// increments up to level.  A negative level selects every increment.
+func selectChain(ctx context.Context, secretKey *stream.SecretKey, sourceDir string, level int32, opts snapshotOptions) (snapshotID, IncrementalFiles, error) {
+	insts, err := SnapshotList(ctx, secretKey, sourceDir)
+	if err != nil {
+		return snapshotID{}, nil, err
+	}
+	snaps := snapshotIDs(insts, opts.host)
+	if len(snaps) == 0 {
+		return snapshotID{}, nil, fmt.Errorf("no backups found")
+	}
+
+	snapID := snaps[0]
+	switch {
+	case opts.snapshot != "":
+		snapID, err = selectSnapshot(snaps, opts.snapshot)
+		if err != nil {
+			return snapshotID{}, nil, err
+		}
+	case !opts.at.IsZero():
+		snapID, err = snapshotAt(insts, snaps, opts.at)
+		if err != nil {
+			return snapshotID{}, nil, err
+		}
+	case len(snaps) > 1:
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return snapshotID{}, nil, fmt.Errorf("%d snapshots "+
+				"found, use --snapshot", len(snaps))
+		}
+		fmt.Fprintln(os.Stderr, "snapshots:")
+		for idx, snap := range snaps {
+			fmt.Fprintf(os.Stderr, "%d: %v\n", idx, snap)
+		}
+		reader := bufio.NewReader(os.Stdin)
+		fmt.Fprintf(os.Stderr, "enter snapshot id: ")
+		os.Stderr.Sync()
+		t, err := reader.ReadString('\n')
+		if err != nil {
+			return snapshotID{}, nil, err
+		}
+		t = strings.Replace(t, "\n", "", -1)
+		fmt.Fprint(os.Stderr, "\n")
+
+		snapID, err = selectSnapshot(snaps, t)
+		if err != nil {
+			return snapshotID{}, nil, err
+		}
+	}
+	log.Printf("snapshot: %v", snapID)
+
+	var chain IncrementalFiles
+	for _, inst := range insts {
+		if inst.Hostname != snapID.Hostname ||
+			!inst.Timestamp.Equal(snapID.Timestamp) {
+			continue
+		}
+		if level >= 0 && inst.Increment > uint16(level) {
+			break
+		}
+		if !opts.at.IsZero() && inst.Created.After(opts.at) {
+			break
+		}
+		if inst.Increment != uint16(len(chain)) {
+			return snapshotID{}, nil, fmt.Errorf("snapshot %v: "+
+				"missing increment %d", snapID, len(chain))
+		}
+		chain = append(chain, inst)
+	}
+	if len(chain) == 0 {
+		return snapshotID{}, nil, fmt.Errorf("snapshot %v was created "+
+			"after %v", snapID, opts.at.Format(time.RFC3339))
+	}
+	return snapID, chain, nil
+}
+
+// openIncrement opens inst and checks that its header matches the listing.
+func openIncrement(inst IncrementalFile, snapID snapshotID, secretKey *stream.SecretKey) (*archive.Reader, error) {
+	r, err := archive.Open(inst.Filename, secretKey)
+	if err != nil {
+		return nil, err
+	}
+	if r.Header.Hostname != snapID.Hostname ||
+		!r.Header.Timestamp.Equal(snapID.Timestamp) {
+		r.Close()
+		return nil, fmt.Errorf("%q inconsistency: got:%v %v expected:%v",
+			inst.Filename, r.Header.Hostname, r.Header.Timestamp, snapID)
+	}
+	if r.Header.Increment != inst.Increment {
+		r.Close()
+		return nil, fmt.Errorf("%q inconsistency: got:%d expected:%d",
+			inst.Filename, r.Header.Increment, inst.Increment)
+	}
+	return r, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotAt(t *testing.T) {
+	base := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	at := func(hours int) time.Time {
+		return base.Add(time.Duration(hours) * time.Hour)
+	}
+	// Host a starts snapshots at 0h and 10h, host b at 5h, each with an
+	// increment an hour later.
+	var insts IncrementalFiles
+	for _, s := range []struct {
+		host  string
+		start int
+	}{{"a", 0}, {"b", 5}, {"a", 10}} {
+		for inc := 0; inc < 2; inc++ {
+			insts = append(insts, IncrementalFile{
+				Hostname:  s.host,
+				Timestamp: at(s.start),
+				Increment: uint16(inc),
+				Created:   at(s.start + inc),
+			})
+		}
+	}
+
+	tests := []struct {
+		name string
+		host string
+		at   int
+		want snapshotID
+		err  string
+	}{
+		{name: "before any", at: -1, err: "no snapshot created"},
+		{name: "one host", at: 3, want: snapshotID{"a", at(0)}},
+		{name: "two hosts", at: 6, err: "snapshots of 2 hosts"},
+		{name: "two hosts later", at: 20, err: "snapshots of 2 hosts"},
+		{name: "host a", host: "a", at: 6, want: snapshotID{"a", at(0)}},
+		{name: "host a later", host: "a", at: 20, want: snapshotID{"a", at(10)}},
+		{name: "host b", host: "b", at: 20, want: snapshotID{"b", at(5)}},
+		{name: "host b before", host: "b", at: 3, err: "no snapshot created"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			snaps := snapshotIDs(insts, test.host)
+			got, err := snapshotAt(insts, snaps, at(test.at))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, %v, want error %q", got, err,
+						test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSelectSnapshot(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	later := ts.Add(time.Hour)
+	snaps := []snapshotID{{"a", ts}, {"b", ts}, {"a", later}}
+
+	tests := []struct {
+		sel  string
+		want snapshotID
+		err  string
+	}{
+		{sel: "latest", want: snaps[2]},
+		{sel: "0", want: snaps[0]},
+		{sel: "2", want: snaps[2]},
+		{sel: "3", err: "invalid id"},
+		{sel: later.Format(time.RFC3339), want: snaps[2]},
+		{sel: ts.Format(time.RFC3339), err: "2 snapshots at"},
+		{sel: ts.Add(time.Minute).Format(time.RFC3339), err: "no snapshot at"},
+		{sel: "yesterday", err: "invalid snapshot"},
+	}
+	for _, test := range tests {
+		got, err := selectSnapshot(snaps, test.sel)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got %v, %v, want error %q", test.sel,
+					got, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.sel, err)
+		} else if got != test.want {
+			t.Errorf("%q: got %v, want %v", test.sel, got, test.want)
+		}
+	}
+
+	// --host resolves the ambiguity.
+	got, err := selectSnapshot(snapshotIDs(IncrementalFiles{
+		{Hostname: "a", Timestamp: ts},
+		{Hostname: "b", Timestamp: ts},
+	}, "b"), ts.Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != snaps[1] {
+		t.Errorf("got %v, want %v", got, snaps[1])
+	}
+}
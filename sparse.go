@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"multus/archive"
+)
+
+// writeExtents writes the data extents of f from r, which holds their
+// contents back to back, leaving holes in between, and sets the size of f
+// to size.
+func writeExtents(f *os.File, r io.Reader, extents []archive.Extent, size int64) error {
+	for _, e := range extents {
+		if _, err := f.Seek(e.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(f, r, e.Length); err != nil {
+			return err
+		}
+	}
+	return f.Truncate(size)
+}
+
+// copyExtents writes the contents of a sparse file whose data extents are
+// read from r to w, filling the holes with zeros, up to size.
+func copyExtents(w io.Writer, r io.Reader, extents []archive.Extent, size int64) error {
+	var offset int64
+	zeros := func(end int64) error {
+		_, err := io.CopyN(w, zeroReader{}, end-offset)
+		offset = end
+		return err
+	}
+	for _, e := range extents {
+		if err := zeros(e.Offset); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, e.Length); err != nil {
+			return err
+		}
+		offset += e.Length
+	}
+	return zeros(size)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	zero(p)
+	return len(p), nil
+}
+
+// holeWriter writes a sparse file sequentially.  Zero-filled ranges that fall
+// in a hole of the destination are skipped rather than written, so the
+// output of a patch keeps the holes of the original file.
+type holeWriter struct {
+	f       *os.File
+	extents []archive.Extent
+	offset  int64
+}
+
+func newHoleWriter(f *os.File, extents []archive.Extent) *holeWriter {
+	return &holeWriter{
+		f:       f,
+		extents: extents,
+	}
+}
+
+func (w *holeWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Drop the extents that end before offset.
+		for len(w.extents) > 0 &&
+			w.extents[0].Offset+w.extents[0].Length <= w.offset {
+			w.extents = w.extents[1:]
+		}
+
+		n := int64(len(p))
+		inHole := true
+		if len(w.extents) > 0 {
+			e := w.extents[0]
+			if w.offset >= e.Offset {
+				inHole = false
+				if end := e.Offset + e.Length - w.offset; end < n {
+					n = end
+				}
+			} else if start := e.Offset - w.offset; start < n {
+				n = start
+			}
+		}
+
+		if !inHole || !isZero(p[:n]) {
+			if _, err := w.f.WriteAt(p[:n], w.offset); err != nil {
+				return written, err
+			}
+		}
+		w.offset += n
+		written += int(n)
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// finish sets the size of the file to the number of bytes written, which
+// creates a trailing hole.
+func (w *holeWriter) finish() error {
+	return w.f.Truncate(w.offset)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
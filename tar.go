@@ -0,0 +1,445 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jrick/ss/stream"
+	"github.com/smtc/rsync"
+	"golang.org/x/sys/unix"
+	"multus/archive"
+)
+
+// tarRestore writes the state of a snapshot to a PAX tar stream instead of a
+// destination.  Every path is written once, when its final record is
+// reached: files whose final record holds their whole contents are streamed
+// from the increment, while the records of files patched by a later level
+// are staged in a temporary directory until then.  Hard links are written
+// last, after their targets, or with the contents of their target when it
+// is not written.
+type tarRestore struct {
+	tw    *tar.Writer
+	paths *pathRewriter
+
+	// final maps the selected archive paths to their last record.
+	final map[string]journalKey
+
+	// store is the directory staging the contents of the files in
+	// staged, which are patched by a later record, in a file per path
+	// that is removed once superseded.  targets holds the targets of
+	// such symlinks.
+	store    string
+	storeSeq int
+	staged   map[string]string
+	targets  map[string]string
+
+	// written holds the archive paths of the regular files written,
+	// which hard links may point to.
+	written map[string]struct{}
+	links   []archive.Metadata
+
+	// rebuild returns the contents of an archive path as of the last
+	// level.
+	rebuild func(path string) (*os.File, error)
+}
+
+// writeTar writes the paths of a snapshot up to level selected by filter to
+// the file output, or to stdout when output is "-".
+func writeTar(ctx context.Context, secretKey *stream.SecretKey, sourceDir, output string, filter *pathFilter, level int32, opts restoreOptions) error {
+	if output == "-" {
+		return restoreTar(ctx, secretKey, sourceDir, os.Stdout, filter,
+			level, opts)
+	}
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o0600)
+	if err != nil {
+		return err
+	}
+	err = restoreTar(ctx, secretKey, sourceDir, f, filter, level, opts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// restoreTar writes the paths of a snapshot up to level selected by filter
+// to w as a PAX tar stream.
+func restoreTar(ctx context.Context, secretKey *stream.SecretKey, sourceDir string, w io.Writer, filter *pathFilter, level int32, opts restoreOptions) error {
+	snapID, chain, err := selectChain(ctx, secretKey, sourceDir, level,
+		opts.snapshotOptions)
+	if err != nil {
+		return err
+	}
+	level = int32(len(chain) - 1)
+
+	t := &tarRestore{
+		tw: tar.NewWriter(w),
+		paths: &pathRewriter{
+			stripPrefix: opts.stripPrefix,
+			maps:        opts.maps,
+			filter:      filter,
+		},
+		final:   make(map[string]journalKey),
+		staged:  make(map[string]string),
+		targets: make(map[string]string),
+		written: make(map[string]struct{}),
+		rebuild: func(path string) (*os.File, error) {
+			return rebuild(ctx, secretKey, snapID, chain, path)
+		},
+	}
+	defer func() {
+		if t.store != "" {
+			os.RemoveAll(t.store)
+		}
+	}()
+
+	log.Printf("Writing level %d as tar...", level)
+	startTime := time.Now()
+	// Increments are read in full to locate the final records, which
+	// verifies them against their trailer before anything is written.
+	for _, inst := range chain {
+		r, err := openIncrement(inst, snapID, secretKey)
+		if err != nil {
+			return err
+		}
+		if err = t.locate(ctx, r); err != nil {
+			r.Close()
+			return err
+		}
+		if err = r.Close(); err != nil {
+			return err
+		}
+	}
+	for _, inst := range chain {
+		log.Printf("----------  APPLYING LEVEL %d  -----------", inst.Increment)
+		log.Printf("file: %q", inst.Filename)
+		r, err := openIncrement(inst, snapID, secretKey)
+		if err != nil {
+			return err
+		}
+		if err = restoreIncrement(ctx, r, t.paths, t.record); err != nil {
+			r.Close()
+			return err
+		}
+		if err = r.Close(); err != nil {
+			return err
+		}
+	}
+	if err = t.writeLinks(); err != nil {
+		return err
+	}
+	if err = t.tw.Close(); err != nil {
+		return err
+	}
+	log.Printf("completed in %v", time.Since(startTime))
+	return nil
+}
+
+// locate records the last record of the selected paths of r.  Every record
+// is read, even from an indexed increment, so that r is verified against
+// its trailer.
+func (t *tarRestore) locate(ctx context.Context, r *archive.Reader) error {
+	for i := 0; ; i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rec, err := r.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if t.paths.match(rec.Metadata.Path) {
+			t.final[rec.Metadata.Path] = journalKey{
+				level: r.Header.Increment,
+				index: i,
+			}
+		}
+	}
+}
+
+func (t *tarRestore) record(r *archive.Reader, i int, rec *archive.Record) error {
+	if err := checkPath(rec.Metadata.Path); err != nil {
+		return err
+	}
+	path := rec.Metadata.Path
+	name, ok := t.paths.rewrite(path)
+	if !ok {
+		return nil
+	}
+	final := t.final[path] == journalKey{level: r.Header.Increment, index: i}
+
+	basis, staged := t.staged[path]
+	target, hasTarget := t.targets[path]
+	delete(t.staged, path)
+	delete(t.targets, path)
+	if staged {
+		// The staged contents are superseded by this record.
+		defer os.Remove(basis)
+	}
+	delta := rec.Kind == archive.KindChange
+	if r.Header.Version < archive.Version2 {
+		delta = staged || hasTarget
+	}
+
+	md := &rec.Metadata
+	fileMode := os.FileMode(md.Attribs.Mode)
+	_, isLink := md.Link()
+	switch {
+	case rec.Kind == archive.KindDelete:
+		return nil
+	case isSymlink(fileMode):
+		var prev *lsEntry
+		if hasTarget {
+			prev = &lsEntry{target: target}
+		}
+		target, err := lsTarget(rec, prev, delta)
+		if err != nil {
+			return err
+		}
+		if !final {
+			t.targets[path] = target
+			return nil
+		}
+		hdr, err := tarHeader(md, name)
+		if err != nil {
+			return err
+		}
+		hdr.Linkname = target
+		return t.tw.WriteHeader(hdr)
+	case isLink:
+		if final {
+			t.links = append(t.links, *md)
+		}
+		return nil
+	case fileMode.IsRegular():
+		if !staged {
+			basis = ""
+		}
+		return t.file(rec, name, final, delta, basis)
+	default:
+		if !final {
+			return nil
+		}
+		hdr, err := tarHeader(md, name)
+		if err != nil {
+			return err
+		}
+		return t.tw.WriteHeader(hdr)
+	}
+}
+
+// file writes the regular file rec to the stream when it is final and stages
+// it otherwise.  basis is the staged file a delta applies to, if any.
+func (t *tarRestore) file(rec *archive.Record, name string, final, delta bool, basis string) error {
+	md := &rec.Metadata
+	extents, sparse, err := md.Extents()
+	if err != nil {
+		return err
+	}
+	hdr, err := tarHeader(md, name)
+	if err != nil {
+		return err
+	}
+	if final && !delta {
+		hdr.Size = rec.DataLen
+		if sparse {
+			hdr.Size = md.Attribs.Size
+		}
+		if err = t.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if sparse {
+			err = copyExtents(t.tw, rec.Data, extents, hdr.Size)
+		} else {
+			_, err = io.CopyN(t.tw, rec.Data, rec.DataLen)
+		}
+		if err != nil {
+			return err
+		}
+		t.written[md.Path] = struct{}{}
+		return nil
+	}
+
+	if t.store == "" {
+		if t.store, err = os.MkdirTemp("", "multus-tar"); err != nil {
+			return err
+		}
+	}
+	t.storeSeq++
+	staged := filepath.Join(t.store, strconv.Itoa(t.storeSeq))
+	f, err := os.OpenFile(staged, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	switch {
+	case delta:
+		err = patchStaged(rec, basis, f)
+	case sparse:
+		err = copyExtents(f, rec.Data, extents, md.Attribs.Size)
+	default:
+		_, err = io.CopyN(f, rec.Data, rec.DataLen)
+	}
+	if err == nil && !final {
+		t.staged[md.Path] = staged
+		return nil
+	}
+	if err == nil {
+		hdr.Size, err = f.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		err = t.tw.WriteHeader(hdr)
+	}
+	if err == nil {
+		_, err = io.Copy(t.tw, io.NewSectionReader(f, 0, hdr.Size))
+	}
+	os.Remove(staged)
+	if err != nil {
+		return err
+	}
+	t.written[md.Path] = struct{}{}
+	return nil
+}
+
+// patchStaged applies the delta rec to the staged file basis, or to empty
+// contents when there is none, and writes the result to w.
+func patchStaged(rec *archive.Record, basis string, w io.Writer) error {
+	if basis == "" {
+		return rsync.Patch(rec.Data, strings.NewReader(""), w)
+	}
+	f, err := os.Open(basis)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return rsync.Patch(rec.Data, f, w)
+}
+
+// writeLinks writes the hard links, as links when their target was written
+// and as a copy of its contents otherwise.
+func (t *tarRestore) writeLinks() error {
+	for i := range t.links {
+		md := &t.links[i]
+		target, _ := md.Link()
+		mapped, ok := t.paths.mapPath(target)
+		name, _ := t.paths.rewrite(md.Path)
+		hdr, err := tarHeader(md, name)
+		if err != nil {
+			return err
+		}
+		if _, written := t.written[target]; ok && written {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = tarName(mapped)
+			if err = t.tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			continue
+		}
+		log.Printf("%q: hard link target %q not written, writing its "+
+			"contents", md.Path, target)
+		if err = t.copyLink(hdr, md.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyLink writes hdr followed by the contents of the hard link path, which
+// are rebuilt from the records of its target.
+func (t *tarRestore) copyLink(hdr *tar.Header, path string) error {
+	f, err := t.rebuild(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr.Size = st.Size()
+	if err = t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(t.tw, f)
+	return err
+}
+
+// tarHeader returns the header of md restored to the rewritten path name.
+// Extended attributes, including ACLs, are kept as SCHILY.xattr records.
+func tarHeader(md *archive.Metadata, name string) (*tar.Header, error) {
+	a := md.Attribs
+	fileMode := os.FileMode(a.Mode)
+	hdr := &tar.Header{
+		Name:    tarName(name),
+		Mode:    tarMode(fileMode),
+		Uid:     int(a.UID),
+		Gid:     int(a.GID),
+		ModTime: time.Unix(0, a.MTim),
+		Format:  tar.FormatPAX,
+	}
+	switch {
+	case isDir(fileMode):
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case isSymlink(fileMode):
+		hdr.Typeflag = tar.TypeSymlink
+	case isCharDevice(fileMode):
+		hdr.Typeflag = tar.TypeChar
+		hdr.Devmajor = int64(unix.Major(a.RDev))
+		hdr.Devminor = int64(unix.Minor(a.RDev))
+	case isDevice(fileMode):
+		hdr.Typeflag = tar.TypeBlock
+		hdr.Devmajor = int64(unix.Major(a.RDev))
+		hdr.Devminor = int64(unix.Minor(a.RDev))
+	case isNamedPipe(fileMode):
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		hdr.Typeflag = tar.TypeReg
+	}
+
+	xattrs, err := md.Xattrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, x := range xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords["SCHILY.xattr."+x.Name] = string(x.Value)
+	}
+	return hdr, nil
+}
+
+// tarName returns the name in the stream of a rewritten path, relative to
+// the directory the stream is extracted in.
+func tarName(path string) string {
+	name := strings.TrimLeft(filepath.ToSlash(path), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// tarMode converts the permissions of fileMode to Unix mode bits.
+func tarMode(fileMode os.FileMode) int64 {
+	mode := int64(fileMode.Perm())
+	if fileMode&os.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if fileMode&os.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if fileMode&os.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+	return mode
+}
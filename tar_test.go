@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"multus/archive"
+)
+
+func TestRestoreTar(t *testing.T) {
+	tb := newTestBackup(t)
+	patched := bytes.Repeat([]byte("patched by later levels\n"), 4096)
+	tb.write("patched", patched, 0o644)
+	tb.write("replaced", []byte("first\n"), 0o644)
+	tb.write("deleted", []byte("deleted\n"), 0o644)
+	tb.write("dir/file", []byte("file\n"), 0o600)
+	if err := os.Link(tb.path("dir/file"), tb.path("hardlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("patched", tb.path("symlink")); err != nil {
+		t.Fatal(err)
+	}
+	tb.backup()
+	copy(patched[1000:], "level 1")
+	tb.write("patched", patched, 0o644)
+	tb.write("replaced", []byte("second\n"), 0o644)
+	if err := os.Remove(tb.path("deleted")); err != nil {
+		t.Fatal(err)
+	}
+	tb.backup()
+	copy(patched[50000:], "level 2")
+	tb.write("patched", patched, 0o644)
+	tb.backup()
+
+	// The staged files are removed once written.
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	var buf bytes.Buffer
+	err := restoreTar(context.Background(), tb.secretKey, tb.cfg.BackupPath,
+		&buf, nil, -1, restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Errorf("staged files left behind: %v", left)
+	}
+
+	entries := make(map[string]*tar.Header)
+	contents := make(map[string][]byte)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := entries[hdr.Name]; ok {
+			t.Errorf("%s written twice", hdr.Name)
+		}
+		entries[hdr.Name] = hdr
+		if contents[hdr.Name], err = io.ReadAll(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := func(path string) string {
+		return tarName(tb.path(path))
+	}
+	for _, path := range []string{"patched", "replaced", "dir/file"} {
+		want, err := os.ReadFile(tb.path(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := entries[name(path)]
+		if hdr == nil || hdr.Typeflag != tar.TypeReg {
+			t.Errorf("%s: not written as a regular file: %v", path, hdr)
+			continue
+		}
+		if !bytes.Equal(contents[name(path)], want) {
+			t.Errorf("%s: contents differ", path)
+		}
+	}
+	if _, ok := entries[name("deleted")]; ok {
+		t.Error("deleted file written")
+	}
+	if hdr := entries[name("symlink")]; hdr == nil || hdr.Typeflag != tar.TypeSymlink ||
+		hdr.Linkname != "patched" {
+		t.Errorf("symlink written as %v", hdr)
+	}
+	hdr := entries[name("hardlink")]
+	if hdr == nil || hdr.Typeflag != tar.TypeLink ||
+		!strings.HasSuffix(hdr.Linkname, "/dir/file") {
+		t.Errorf("hard link written as %v", hdr)
+	}
+	if hdr := entries[name("dir")+"/"]; hdr == nil || hdr.Typeflag != tar.TypeDir {
+		t.Errorf("directory written as %v", hdr)
+	}
+}
+
+func TestTarHeaderDevice(t *testing.T) {
+	md := &archive.Metadata{
+		Path: "/dev/x",
+		Attribs: archive.FileAttributes{
+			Mode: uint32(os.ModeDevice | os.ModeCharDevice | 0o600),
+			RDev: unix.Mkdev(0x12345, 0xabcde),
+		},
+	}
+	hdr, err := tarHeader(md, md.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Typeflag != tar.TypeChar || hdr.Devmajor != 0x12345 || hdr.Devminor != 0xabcde {
+		t.Errorf("device written as %c %x:%x", hdr.Typeflag, hdr.Devmajor,
+			hdr.Devminor)
+	}
+}
@@ -2,9 +2,7 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
-	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -12,12 +10,10 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
-	"syscall"
 	"time"
 
 	"github.com/jrick/ss/stream"
-	"github.com/smtc/rsync"
-	"golang.org/x/sync/errgroup"
+	"multus/archive"
 )
 
 type Signature []byte
@@ -163,6 +159,7 @@ func NewSignatureCache(sigFile string, timeStamp time.Time, instance uint16) (*S
 		numSigsOffset: 2 + 2 + 1 + int64(len(hostname)) + 8,
 		wOffset:       int64(offset),
 		timeStamp:     timeStamp,
+		version:       FormatVersion,
 		hostname:      hostname,
 		instance:      instance,
 		write:         true,
@@ -192,6 +189,11 @@ func LoadSignatureCache(sigfile string) (*SignatureCache, error) {
 	var goffset int64
 	var offset int
 	version := binary.LittleEndian.Uint16(buf[offset : offset+2])
+	if version == 0 || version > FormatVersion {
+		fd.Close()
+		return nil, fmt.Errorf("%q: unsupported format version %d (max %d)",
+			sigfile, version, FormatVersion)
+	}
 	offset += 2
 	instance := binary.LittleEndian.Uint16(buf[offset : offset+2])
 	offset += 2
@@ -269,132 +271,20 @@ func LoadSignatureCache(sigfile string) (*SignatureCache, error) {
 	return sc, nil
 }
 
-type FileAttributes struct {
-	Size int64
-	MTim int64
-	RDev uint64
-	Mode uint32
-	UID  uint32
-	GID  uint32
-}
-
-func (f FileAttributes) IsEmpty() bool {
-	return f.Size == 0 && f.MTim == 0 && f.RDev == 0 &&
-		f.Mode == 0 && f.UID == 0 && f.GID == 0
-}
-
-func (f *FileAttributes) Deserialize(buf []byte) error {
-	if len(buf) != 36 {
-		return fmt.Errorf("invalid length: got:%d want:%d",
-			len(buf), 36)
-	}
-	f.Size = int64(binary.LittleEndian.Uint64(buf[0:8]))
-	f.MTim = int64(binary.LittleEndian.Uint64(buf[8:16]))
-	f.RDev = binary.LittleEndian.Uint64(buf[16:24])
-	f.Mode = binary.LittleEndian.Uint32(buf[24:28])
-	f.UID = binary.LittleEndian.Uint32(buf[28:32])
-	f.GID = binary.LittleEndian.Uint32(buf[32:36])
-
-	return nil
-}
-
-func (f FileAttributes) Serialize(dstBuf *bytes.Buffer) error {
-	var buf [36]byte
-	binary.LittleEndian.PutUint64(buf[0:8], uint64(f.Size))
-	binary.LittleEndian.PutUint64(buf[8:16], uint64(f.MTim))
-	binary.LittleEndian.PutUint64(buf[16:24], f.RDev)
-	binary.LittleEndian.PutUint32(buf[24:28], f.Mode)
-	binary.LittleEndian.PutUint32(buf[28:32], f.UID)
-	binary.LittleEndian.PutUint32(buf[32:36], f.GID)
-
-	_, err := dstBuf.Write(buf[:])
-	return err
-}
-
 var (
-	fSig = new(bytes.Buffer)
 	gSig = new(bytes.Reader)
 )
 
-func (f FileAttributes) Signature(dstBuf *bytes.Buffer) error {
-	fSig.Reset()
-	if err := f.Serialize(fSig); err != nil {
-		return err
-	}
-
-	return rsync.GenSign(fSig, int64(fSig.Len()), 2048, dstBuf)
-}
-
-type Metadata struct {
-	Path    string
-	Attribs FileAttributes
-}
-
-func (m *Metadata) DataLen() int64 {
-	return m.Attribs.Size
-}
-
-func (m *Metadata) Serialize(dstBuf *bytes.Buffer) error {
-	var offset int
-	pathLen := len(m.Path)
-	buf := make([]byte, 2+pathLen+36)
-
-	binary.LittleEndian.PutUint16(buf[offset:offset+2], uint16(pathLen))
-	offset += 2
-	copy(buf[offset:offset+pathLen], m.Path)
-	offset += pathLen
-
-	if _, err := dstBuf.Write(buf[0:offset]); err != nil {
-		return err
-	}
-	return m.Attribs.Serialize(dstBuf)
-}
-
-func (m *Metadata) Signature(dstBuf *bytes.Buffer) error {
-	return m.Attribs.Signature(dstBuf)
-}
-
-func NewMetadata(filepath string) (*Metadata, error) {
-	stat, err := os.Lstat(filepath)
-	if err != nil {
-		return nil, err
-	}
-	statT, ok := stat.Sys().(*syscall.Stat_t)
-	if !ok {
-		return nil, fmt.Errorf("stat returned type %T", statT)
-	}
-
-	fileAttributes := FileAttributes{
-		Size: stat.Size(),
-		MTim: stat.ModTime().UnixNano(),
-		Mode: uint32(stat.Mode()),
-		UID:  statT.Uid,
-		GID:  statT.Gid,
-		RDev: statT.Rdev,
-	}
-	MD := Metadata{
-		Attribs: fileAttributes,
-		Path:    filepath,
-	}
-	return &MD, nil
-}
-
 type Snapshot struct {
-	instance     uint16
-	uid          int
-	gid          int
-	fd           *os.File
-	gz           *gzip.Writer
-	pipeR        *io.PipeReader
-	pipeW        *io.PipeWriter
-	eg           *errgroup.Group
-	bytesWritten int64
-	err          error
-	readBuffer   *bytes.Reader
-	writeBuffer  *bytes.Buffer
+	instance uint16
+	uid      int
+	gid      int
+	fd       *os.File
+	aw       *archive.Writer
+	err      error
 }
 
-func GenSignature(dstBuf *bytes.Buffer, md *Metadata, dataReader io.ReadSeeker, len int64) error {
+func GenSignature(dstBuf *bytes.Buffer, md *archive.Metadata, dataReader io.ReadSeeker, len int64) error {
 	err := md.Signature(dstBuf)
 	if err != nil {
 		return err
@@ -418,71 +308,35 @@ func GenSignature(dstBuf *bytes.Buffer, md *Metadata, dataReader io.ReadSeeker,
 	return nil
 }
 
-func (s *Snapshot) Add(md *Metadata, dataReader io.ReadSeeker, dataLen int64) error {
+func (s *Snapshot) Add(kind archive.Kind, md *archive.Metadata, dataReader io.Reader, dataLen int64) error {
 	if s.err != nil {
 		return s.err
 	}
-	s.writeBuffer.Reset()
-	if err := md.Serialize(s.writeBuffer); err != nil {
-		s.err = err
-		return err
-	}
-
-	numBytes, err := s.gz.Write(s.writeBuffer.Bytes())
-	s.bytesWritten += int64(numBytes)
+	numBytes, err := s.aw.Add(kind, md, dataReader, dataLen)
 	if err != nil {
 		s.err = err
 		return err
 	}
-
-	var dataLenBytes [8]byte
-	binary.LittleEndian.PutUint64(dataLenBytes[:], uint64(dataLen))
-	numBytes, err = s.gz.Write(dataLenBytes[:])
-	s.bytesWritten += int64(numBytes)
-	if err != nil {
-		s.err = err
-		return err
-	}
-
-	if dataReader != nil {
-		numBytes, err := io.CopyN(s.gz, dataReader, dataLen)
-		s.bytesWritten += numBytes
-		if err != nil {
-			s.err = err
-			return err
-		}
-
-		if numBytes != dataLen {
-			sysLog.Warning(fmt.Sprintf("%q changed size during write: %d != %d",
-				md.Path, dataLen, numBytes))
-		}
+	if dataReader != nil && numBytes != dataLen {
+		sysLog.Warning(fmt.Sprintf("%q changed size during write: %d != %d",
+			md.Path, dataLen, numBytes))
 	}
 	return nil
 }
 
-func (s *Snapshot) Close() error {
-	if err := s.gz.Flush(); err != nil {
-		s.err = err
-		s.gz.Close()
-		s.fd.Close()
-		return err
-	}
-	if err := s.gz.Close(); err != nil {
-		s.err = err
-		s.fd.Close()
-		return err
-	}
-	if err := s.pipeW.Close(); err != nil {
-		s.err = err
-		s.fd.Close()
-		return err
+func (s *Snapshot) Delete(path string) error {
+	if s.err != nil {
+		return s.err
 	}
-	if err := s.eg.Wait(); err != nil {
+	if err := s.aw.Delete(path); err != nil {
 		s.err = err
-		s.fd.Close()
 		return err
 	}
-	if err := s.pipeR.Close(); err != nil {
+	return nil
+}
+
+func (s *Snapshot) Close() error {
+	if err := s.aw.Close(); err != nil {
 		s.err = err
 		s.fd.Close()
 		return err
@@ -506,8 +360,12 @@ func (s *Snapshot) Name() string {
 	return s.fd.Name()
 }
 
+func (s *Snapshot) Trailer() archive.Trailer {
+	return s.aw.Trailer()
+}
+
 func (s *Snapshot) BytesWritten() int64 {
-	return s.bytesWritten
+	return s.aw.BytesWritten()
 }
 
 // SnapshotList returns a sorted list of files based on increment version.
@@ -523,68 +381,30 @@ func SnapshotList(ctx context.Context, secretKey *stream.SecretKey, dir string)
 		if filepath.Ext(file.Name()) != ".enc" {
 			continue
 		}
-		fileName := filepath.Join(dir, file.Name())
-		fd, err := os.Open(fileName)
-		if err != nil {
-			return nil, err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
-
-		header, err := stream.ReadHeader(fd)
+		fileName := filepath.Join(dir, file.Name())
+		r, err := archive.Open(fileName, secretKey)
 		if err != nil {
-			fd.Close()
 			return nil, err
 		}
-		symKey, err := stream.Decapsulate(header, secretKey)
-		if err != nil {
-			fd.Close()
-			return nil, err
+		created := r.Header.Created
+		if created.IsZero() {
+			// Increments older than archive.Version4 do not
+			// record when they were created.  They were
+			// written shortly before the file was last
+			// modified.
+			created = file.ModTime()
 		}
-
-		pipeR, pipeW := io.Pipe()
-		eg, _ := errgroup.WithContext(ctx)
-		eg.Go(func() error {
-			gzR, err := gzip.NewReader(pipeR)
-			if err != nil {
-				return err
-			}
-			defer gzR.Close()
-			b := new(bytes.Buffer)
-			if _, err = io.CopyN(b, gzR, 3); err != nil {
-				return err
-			}
-			hostLen := int64(b.Bytes()[2])
-			if _, err = io.CopyN(b, gzR, hostLen+8+2); err != nil {
-				return err
-			}
-			if _, err = io.Copy(ioutil.Discard, pipeR); err != nil {
-				return err
-			}
-			var iFile IncrementalFile
-			offset := int64(3)
-			iFile.Hostname = string(b.Bytes()[offset : offset+hostLen])
-			offset += hostLen
-			iFile.Timestamp = time.Unix(int64(binary.LittleEndian.Uint64(b.Bytes()[offset:offset+8])), 0)
-			offset += 8
-			iFile.Increment = binary.LittleEndian.Uint16(b.Bytes()[offset : offset+2])
-			iFile.Filename = fileName
-			incrementalFiles = append(incrementalFiles, iFile)
-			return nil
+		incrementalFiles = append(incrementalFiles, IncrementalFile{
+			Hostname:  r.Header.Hostname,
+			Timestamp: r.Header.Timestamp,
+			Increment: r.Header.Increment,
+			Created:   created,
+			Filename:  fileName,
 		})
-		err = stream.Decrypt(pipeW, fd, header.Bytes, symKey)
-		if err != nil {
-			pipeW.Close()
-			pipeR.Close()
-			fd.Close()
-			return nil, err
-		}
-		pipeW.Close()
-		err = eg.Wait()
-		pipeR.Close()
-		if err != nil {
-			fd.Close()
-			return nil, err
-		}
-		if err = fd.Close(); err != nil {
+		if err = r.Close(); err != nil {
 			return nil, err
 		}
 	}
@@ -613,6 +433,7 @@ type IncrementalFile struct {
 	Hostname  string
 	Timestamp time.Time
 	Increment uint16
+	Created   time.Time
 	Filename  string
 }
 
@@ -622,7 +443,14 @@ func (i IncrementalFiles) Len() int {
 	return len(i)
 }
 
+// Less orders increments chronologically by snapshot and then by level.
 func (i IncrementalFiles) Less(a, b int) bool {
+	if !i[a].Timestamp.Equal(i[b].Timestamp) {
+		return i[a].Timestamp.Before(i[b].Timestamp)
+	}
+	if i[a].Hostname != i[b].Hostname {
+		return i[a].Hostname < i[b].Hostname
+	}
 	return i[a].Increment < i[b].Increment
 }
 
@@ -630,70 +458,33 @@ func (i IncrementalFiles) Swap(a, b int) {
 	i[a], i[b] = i[b], i[a]
 }
 
-func NewSnapshot(ctx context.Context, pubKey *stream.PublicKey, uid, gid, gzLevel int, dataDir, hostname string,
-	timeStamp time.Time, instance uint16, version uint16) (*Snapshot, error) {
-
-	header, symKey, err := stream.Encapsulate(rand.Reader, pubKey)
-	if err != nil {
-		return nil, err
-	}
+func NewSnapshot(pubKey *stream.PublicKey, uid, gid, gzLevel int, dataDir, hostname string,
+	timeStamp time.Time, instance uint16, created time.Time) (*Snapshot, error) {
 
 	d := fmt.Sprintf("%d%02d%02d%02d%02d", timeStamp.Year(), timeStamp.Month(), timeStamp.Day(), timeStamp.Hour(), timeStamp.Minute())
 	filename := filepath.Join(dataDir, fmt.Sprintf("%s-%s.%d.gz.enc", d, hostname, instance))
-	fd, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0600)
+	fd, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		return nil, err
 	}
 
-	pipeR, pipeW := io.Pipe()
-	eg, _ := errgroup.WithContext(ctx)
-	eg.Go(func() error {
-		return stream.Encrypt(fd, pipeR, header, symKey)
+	aw, err := archive.Create(fd, pubKey, gzLevel, archive.Header{
+		Hostname:  hostname,
+		Timestamp: timeStamp,
+		Increment: instance,
+		Created:   created,
 	})
-	gz, err := gzip.NewWriterLevel(pipeW, gzLevel)
-	if err != nil {
-		pipeW.Close()
-		pipeR.Close()
-		fd.Close()
-		os.Remove(fd.Name())
-		return nil, err
-	}
-
-	hostLen := len(hostname)
-	b := make([]byte, 2+1+hostLen+8+2)
-
-	offset := 0
-	binary.LittleEndian.PutUint16(b[offset:offset+2], version)
-	offset += 2
-	b[offset] = byte(hostLen)
-	offset++
-	copy(b[offset:offset+hostLen], []byte(hostname))
-	offset += hostLen
-	binary.LittleEndian.PutUint64(b[offset:offset+8], uint64(timeStamp.Unix()))
-	offset += 8
-	binary.LittleEndian.PutUint16(b[offset:offset+2], instance)
-
-	numBytes, err := gz.Write(b)
 	if err != nil {
-		gz.Close()
-		pipeW.Close()
-		pipeR.Close()
 		fd.Close()
 		os.Remove(fd.Name())
 		return nil, err
 	}
 
 	return &Snapshot{
-		instance:     instance,
-		uid:          uid,
-		gid:          gid,
-		fd:           fd,
-		gz:           gz,
-		pipeW:        pipeW,
-		pipeR:        pipeR,
-		eg:           eg,
-		bytesWritten: int64(numBytes),
-		readBuffer:   new(bytes.Reader),
-		writeBuffer:  new(bytes.Buffer),
+		instance: instance,
+		uid:      uid,
+		gid:      gid,
+		fd:       fd,
+		aw:       aw,
 	}, nil
 }
@@ -32,16 +32,6 @@ func isSymlink(filemode os.FileMode) bool {
 	return filemode&os.ModeSymlink == os.ModeSymlink
 }
 
-/*
-func major(rdev uint64) uint64 {
-	return (rdev >> 8) & 0xff
-}
-
-func minor(rdev uint64) uint64 {
-	return (rdev & 0xff) | ((rdev & 0xffff0000) >> 8)
-}
-*/
-
 func signatureFromReader(dstBuf *bytes.Buffer, fd io.ReadSeeker, len int64) error {
 	// Save the current offset
 	savedOffset, err := fd.Seek(0, 1)
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jrick/ss/stream"
+	"multus/archive"
+)
+
+// verifyEntry is the backed up state of a restored path.
+type verifyEntry struct {
+	lsEntry
+
+	// sig is the signature the path was backed up with.  It is nil when
+	// the signature cache holds it or when rebuild is set.
+	sig []byte
+
+	// rebuild is set for files whose contents were last backed up as a
+	// delta.  Their contents are rebuilt from the chain when checked.
+	rebuild bool
+}
+
+// verifier compares a restored destination against the signatures of the
+// snapshot it was restored from.
+type verifier struct {
+	destDir string
+	paths   *pathRewriter
+
+	// sc is the signature cache of the backup when it was written by
+	// the level verified, nil otherwise.
+	sc *SignatureCache
+
+	tree map[string]*verifyEntry
+
+	// rebuild returns the contents of an archive path as of the level
+	// verified.
+	rebuild func(path string) (*os.File, error)
+
+	mismatched int
+	missing    int
+	extra      int
+	unverified int
+}
+
+// verifyRestore recomputes the signature of every path restored to destDir
+// from a snapshot up to level and compares it with the one it was backed up
+// with, reporting the mismatched, missing and extra paths.  The signatures
+// are taken from the signature cache when it was written by that level and
+// recomputed from the records otherwise.
+func verifyRestore(ctx context.Context, secretKey *stream.SecretKey, sourceDir, destDir string, filter *pathFilter, level int32, opts restoreOptions) error {
+	snapID, chain, err := selectChain(ctx, secretKey, sourceDir, level,
+		opts.snapshotOptions)
+	if err != nil {
+		return err
+	}
+	level = int32(len(chain) - 1)
+
+	v := &verifier{
+		destDir: destDir,
+		paths: &pathRewriter{
+			stripPrefix: opts.stripPrefix,
+			maps:        opts.maps,
+			filter:      filter,
+			symlinks:    opts.rewriteSymlinks,
+		},
+		sc:   levelSignatures(sourceDir, snapID, level),
+		tree: make(map[string]*verifyEntry),
+		rebuild: func(path string) (*os.File, error) {
+			return rebuild(ctx, secretKey, snapID, chain, path)
+		},
+	}
+	defer v.sc.Close()
+	if v.sc != nil {
+		log.Printf("verifying %v level %d against the signature cache",
+			snapID, level)
+	} else {
+		log.Printf("verifying %v level %d against the records", snapID,
+			level)
+	}
+
+	for _, inst := range chain {
+		r, err := openIncrement(inst, snapID, secretKey)
+		if err != nil {
+			return err
+		}
+		if err = restoreIncrement(ctx, r, v.paths, v.record); err != nil {
+			r.Close()
+			return err
+		}
+		if err = r.Close(); err != nil {
+			return err
+		}
+	}
+
+	wanted := map[string]struct{}{destDir: {}}
+	sorted := make([]string, 0, len(v.tree))
+	for path := range v.tree {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+	for _, path := range sorted {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rewritten, _ := v.paths.rewrite(path)
+		dest := filepath.Join(destDir, rewritten)
+		for p := dest; p != destDir; p = filepath.Dir(p) {
+			wanted[p] = struct{}{}
+		}
+		if err = v.check(path, dest); err != nil {
+			return err
+		}
+	}
+	if err = v.extras(wanted); err != nil {
+		return err
+	}
+
+	fmt.Printf("verified %d paths: %d mismatched, %d missing, %d extra\n",
+		len(v.tree), v.mismatched, v.missing, v.extra)
+	if v.unverified > 0 {
+		fmt.Printf("%d paths missing from the signature cache only had "+
+			"their attributes verified\n", v.unverified)
+	}
+	if v.mismatched+v.missing+v.extra > 0 {
+		return fmt.Errorf("%q does not match %v level %d", destDir,
+			snapID, level)
+	}
+	return nil
+}
+
+// levelSignatures returns the signature cache of sourceDir when it was
+// written by the backup of level of snapID, nil otherwise.
+func levelSignatures(sourceDir string, snapID snapshotID, level int32) *SignatureCache {
+	sigFile := filepath.Join(sourceDir, "sig.cache")
+	sc, err := LoadSignatureCache(sigFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("%q: %v", sigFile, err)
+		}
+		return nil
+	}
+	if sc.hostname != snapID.Hostname ||
+		!sc.timeStamp.Equal(snapID.Timestamp) ||
+		int32(sc.Instance()) != level {
+		sc.Close()
+		return nil
+	}
+	return sc
+}
+
+// record replays rec into the backed up state.
+func (v *verifier) record(r *archive.Reader, i int, rec *archive.Record) error {
+	if err := checkPath(rec.Metadata.Path); err != nil {
+		return err
+	}
+	path := rec.Metadata.Path
+	if !v.paths.match(path) {
+		return nil
+	}
+	if rec.Kind == archive.KindDelete {
+		delete(v.tree, path)
+		return nil
+	}
+
+	prev := v.tree[path]
+	delta := rec.Kind == archive.KindChange
+	if r.Header.Version < archive.Version2 {
+		delta = prev != nil
+	}
+	e := &verifyEntry{lsEntry: lsEntry{md: rec.Metadata}}
+	fileMode := os.FileMode(rec.Metadata.Attribs.Mode)
+	_, isLink := rec.Metadata.Link()
+	sig := new(bytes.Buffer)
+	var err error
+	switch {
+	case isSymlink(fileMode):
+		var basis *lsEntry
+		if prev != nil {
+			basis = &prev.lsEntry
+		}
+		e.target, err = lsTarget(rec, basis, delta)
+		if err != nil {
+			return err
+		}
+		err = GenSignature(sig, &e.md, strings.NewReader(e.target),
+			int64(len(e.target)))
+	case isLink || !fileMode.IsRegular():
+		err = GenSignature(sig, &e.md, nil, 0)
+	case v.sc != nil:
+		sig = nil
+	case delta:
+		sig = nil
+		e.rebuild = true
+	default:
+		err = v.fileSignature(sig, rec)
+	}
+	if err != nil {
+		return fmt.Errorf("%q: %w", path, err)
+	}
+	if sig != nil {
+		e.sig = sig.Bytes()
+	}
+	v.tree[path] = e
+	return nil
+}
+
+// fileSignature computes the signature of the full contents of a regular
+// file record.  Sparse files and contents larger than memoryLimit are
+// written to a temporary file first.
+func (v *verifier) fileSignature(sig *bytes.Buffer, rec *archive.Record) error {
+	extents, sparse, err := rec.Metadata.Extents()
+	if err != nil {
+		return err
+	}
+	size := rec.Metadata.Attribs.Size
+	if !sparse && rec.DataLen <= memoryLimit {
+		buf := make([]byte, rec.DataLen)
+		if _, err = io.ReadFull(rec.Data, buf); err != nil {
+			return err
+		}
+		return GenSignature(sig, &rec.Metadata, bytes.NewReader(buf),
+			int64(len(buf)))
+	}
+
+	f, err := os.CreateTemp("", "multus-verify")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if sparse {
+		err = writeExtents(f, rec.Data, extents, size)
+	} else {
+		_, err = io.CopyN(f, rec.Data, rec.DataLen)
+		size = rec.DataLen
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return GenSignature(sig, &rec.Metadata, f, size)
+}
+
+// rebuiltSignature computes the signature of the file e, last backed up as
+// a delta, from its contents rebuilt from the chain.
+func (v *verifier) rebuiltSignature(sig *bytes.Buffer, e *verifyEntry) error {
+	f, err := v.rebuild(e.md.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return GenSignature(sig, &e.md, f, st.Size())
+}
+
+// check compares the archive path restored to dest with its backed up
+// state.
+func (v *verifier) check(path, dest string) error {
+	e := v.tree[path]
+	md, err := v.restoredMetadata(e, dest)
+	if err != nil {
+		if os.IsNotExist(err) {
+			v.missing++
+			fmt.Printf("%q: missing\n", dest)
+			return nil
+		}
+		return err
+	}
+
+	want := new(bytes.Buffer)
+	if v.sc != nil {
+		if err = v.sc.Get(want, path); err != nil {
+			return err
+		}
+	} else if e.sig != nil {
+		want.Write(e.sig)
+	} else if e.rebuild {
+		if err = v.rebuiltSignature(want, e); err != nil {
+			return fmt.Errorf("%q: %w", path, err)
+		}
+	}
+	got := new(bytes.Buffer)
+	if want.Len() > 0 {
+		err = v.signature(got, e, md, dest)
+	} else {
+		// Only the attributes can be compared.
+		v.unverified++
+		if err = e.md.Signature(want); err == nil {
+			err = md.Signature(got)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%q: %w", dest, err)
+	}
+	if bytes.Equal(want.Bytes(), got.Bytes()) {
+		return nil
+	}
+	v.mismatched++
+	diffs := attribDiffs(&e.md, md)
+	if len(diffs) == 0 {
+		diffs = []string{"contents"}
+	}
+	fmt.Printf("%q: mismatched %s\n", dest, strings.Join(diffs, ", "))
+	return nil
+}
+
+// restoredMetadata returns the metadata of dest as it would have been backed
+// up.  Directory sizes depend on the file system and are not restored, hard
+// links are recorded as links to their target and rewritten symlink targets
+// are put back.
+func (v *verifier) restoredMetadata(e *verifyEntry, dest string) (*archive.Metadata, error) {
+	md, err := archive.NewMetadata(dest)
+	if err != nil {
+		return nil, err
+	}
+	md.Path = e.md.Path
+	fileMode := os.FileMode(md.Attribs.Mode)
+	switch {
+	case isDir(fileMode):
+		md.Attribs.Size = e.md.Attribs.Size
+	case isSymlink(fileMode):
+		target, err := os.Readlink(dest)
+		if err != nil {
+			return nil, err
+		}
+		if target != e.target &&
+			target == v.paths.rewriteTarget(e.target, v.destDir) {
+			md.Attribs.Size = int64(len(e.target))
+		}
+	case fileMode.IsRegular():
+		target, ok := e.md.Link()
+		if !ok {
+			break
+		}
+		mapped, ok := v.paths.mapPath(target)
+		if !ok {
+			break
+		}
+		fi, err := os.Lstat(dest)
+		if err != nil {
+			return nil, err
+		}
+		tfi, err := os.Lstat(filepath.Join(v.destDir, mapped))
+		if err == nil && os.SameFile(fi, tfi) {
+			md.SetLink(target)
+		}
+	}
+	return md, nil
+}
+
+// signature computes the signature of dest, restored from e, the way backup
+// does.
+func (v *verifier) signature(sig *bytes.Buffer, e *verifyEntry, md *archive.Metadata, dest string) error {
+	fileMode := os.FileMode(md.Attribs.Mode)
+	_, isLink := md.Link()
+	switch {
+	case isSymlink(fileMode):
+		target, err := os.Readlink(dest)
+		if err != nil {
+			return err
+		}
+		if target == v.paths.rewriteTarget(e.target, v.destDir) {
+			target = e.target
+		}
+		return GenSignature(sig, md, strings.NewReader(target),
+			int64(len(target)))
+	case isLink || !fileMode.IsRegular():
+		return GenSignature(sig, md, nil, 0)
+	default:
+		f, err := os.Open(dest)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return GenSignature(sig, md, f, md.Attribs.Size)
+	}
+}
+
+// extras reports the paths of the destination that are neither restored
+// paths nor their parents.
+func (v *verifier) extras(wanted map[string]struct{}) error {
+	journal := filepath.Join(v.destDir, journalName)
+	err := filepath.WalkDir(v.destDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == v.destDir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if _, ok := wanted[path]; ok || path == journal {
+			return nil
+		}
+		v.extra++
+		fmt.Printf("%q: extra\n", path)
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return err
+}
+
+// attribDiffs names the attributes of got that differ from want.
+func attribDiffs(want, got *archive.Metadata) []string {
+	var diffs []string
+	w, g := want.Attribs, got.Attribs
+	if os.FileMode(w.Mode).Type() != os.FileMode(g.Mode).Type() {
+		return []string{"type"}
+	}
+	if w.Mode != g.Mode {
+		diffs = append(diffs, "mode")
+	}
+	if w.UID != g.UID || w.GID != g.GID {
+		diffs = append(diffs, "owner")
+	}
+	if w.Size != g.Size {
+		diffs = append(diffs, "size")
+	}
+	if w.MTim != g.MTim {
+		diffs = append(diffs, "mtime")
+	}
+	if w.RDev != g.RDev {
+		diffs = append(diffs, "device")
+	}
+	if len(diffs) > 0 {
+		return diffs
+	}
+	wsig, gsig := new(bytes.Buffer), new(bytes.Buffer)
+	if want.Signature(wsig) == nil && got.Signature(gsig) == nil &&
+		!bytes.Equal(wsig.Bytes(), gsig.Bytes()) {
+		// Xattrs, flags, links or extents.
+		diffs = append(diffs, "attributes")
+	}
+	return diffs
+}
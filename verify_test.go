@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestVerifyDelta(t *testing.T) {
+	tb := newTestBackup(t)
+	data := bytes.Repeat([]byte("patched by later levels\n"), 4096)
+	tb.write("file", data, 0o644)
+	tb.backup()
+	copy(data[1000:], "level 1")
+	tb.write("file", data, 0o644)
+	tb.backup()
+	copy(data[50000:], "level 2")
+	tb.write("file", data, 0o644)
+	tb.backup()
+
+	// The signature cache is that of level 2, so the contents of level 1,
+	// last backed up as a delta, are rebuilt.
+	ctx := context.Background()
+	dest := tb.restore(1, restoreOptions{})
+	err := verifyRestore(ctx, tb.secretKey, tb.cfg.BackupPath, dest, nil, 1,
+		restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Contents changed behind the same size and mtime are found.
+	file := dest + tb.path("file")
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(b[1000:], "tampered")
+	if err = os.WriteFile(file, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(file, time.Now(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	err = verifyRestore(ctx, tb.secretKey, tb.cfg.BackupPath, dest, nil, 1,
+		restoreOptions{})
+	if err == nil {
+		t.Error("changed contents verified")
+	}
+}
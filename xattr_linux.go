@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"golang.org/x/sys/unix"
+	"multus/archive"
+)
+
+// xattrOps accesses the extended attributes of a path, through a
+// descriptor or a path that does not follow the final component.
+type xattrOps struct {
+	list   func(dest []byte) (int, error)
+	remove func(name string) error
+	set    func(name string, value []byte) error
+}
+
+func fdXattrs(fd int) xattrOps {
+	return xattrOps{
+		list:   func(dest []byte) (int, error) { return unix.Flistxattr(fd, dest) },
+		remove: func(name string) error { return unix.Fremovexattr(fd, name) },
+		set: func(name string, value []byte) error {
+			return unix.Fsetxattr(fd, name, value, 0)
+		},
+	}
+}
+
+func pathXattrs(path string) xattrOps {
+	return xattrOps{
+		list:   func(dest []byte) (int, error) { return unix.Llistxattr(path, dest) },
+		remove: func(name string) error { return unix.Lremovexattr(path, name) },
+		set: func(name string, value []byte) error {
+			return unix.Lsetxattr(path, name, value, 0)
+		},
+	}
+}
+
+// restoreXattrs makes the extended attributes of p match md.  This must be
+// done after chown, which clears security.capability.  Failures are logged
+// since not every destination supports every namespace.
+func restoreXattrs(p *destPath, md *archive.Metadata) {
+	xattrs, err := md.Xattrs()
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+
+	// Regular files and directories are opened without following
+	// symlinks.  Symlinks, devices and named pipes, which cannot be
+	// opened or should not be, are reached through the descriptor of
+	// their parent, as are files the restore cannot read.
+	ops := pathXattrs(fmt.Sprintf("/proc/self/fd/%d/%s", p.dir, p.name))
+	mode := os.FileMode(md.Attribs.Mode)
+	if mode.IsRegular() || mode.IsDir() {
+		fd, err := unix.Openat(p.dir, p.name, unix.O_RDONLY|
+			unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err == nil {
+			defer unix.Close(fd)
+			ops = fdXattrs(fd)
+		}
+	}
+
+	want := make(map[string]struct{}, len(xattrs))
+	for _, x := range xattrs {
+		want[x.Name] = struct{}{}
+	}
+	names, err := listXattrs(ops)
+	if err != nil {
+		if !errors.Is(err, unix.ENOTSUP) {
+			log.Printf("%q: list xattrs: %v", p.path, err)
+		}
+	}
+	for _, name := range names {
+		if _, ok := want[name]; ok {
+			continue
+		}
+		if err = ops.remove(name); err != nil &&
+			!errors.Is(err, unix.ENODATA) {
+			log.Printf("%q: remove xattr %q: %v", p.path, name, err)
+		}
+	}
+
+	for _, x := range xattrs {
+		if err = ops.set(x.Name, x.Value); err != nil {
+			log.Printf("%q: set xattr %q: %v", p.path, x.Name, err)
+		}
+	}
+}
+
+func listXattrs(ops xattrOps) ([]string, error) {
+	for {
+		size, err := ops.list(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = ops.list(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, name := range bytes.Split(buf[:size], []byte{0}) {
+			if len(name) != 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+// restoreFlags sets the recorded inode flags of f.  Flags such as immutable
+// prevent later changes, so they are applied once everything else has been
+// restored.
+func restoreFlags(f *os.File, flags uint32) {
+	path := f.Name()
+	fd := int(f.Fd())
+	current, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		log.Printf("%q: get flags: %v", path, err)
+		return
+	}
+	current = current&^archive.FlagsMask | flags&archive.FlagsMask
+	err = unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(current))
+	if err != nil {
+		log.Printf("%q: set flags: %v", path, err)
+	}
+}
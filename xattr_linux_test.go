@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRestoreXattrs(t *testing.T) {
+	tb := newTestBackup(t)
+	tb.write("file", []byte("file\n"), 0o644)
+	tb.write("unreadable", []byte("unreadable\n"), 0)
+	if err := os.Mkdir(tb.path("dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(tb.path("file"), "user.test", []byte("v1"), 0); err != nil {
+		t.Skip(err)
+	}
+	xattrs := map[string]string{
+		"file":       "user.test",
+		"unreadable": "user.test",
+		"dir":        "user.test",
+	}
+	for name, attr := range xattrs {
+		if err := unix.Setxattr(tb.path(name), attr, []byte("v1"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only privileged namespaces apply to symlinks and named pipes.
+	if os.Geteuid() == 0 {
+		if err := os.Symlink("file", tb.path("link")); err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Mkfifo(tb.path("fifo"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"link", "fifo"} {
+			xattrs[name] = "trusted.test"
+			err := unix.Lsetxattr(tb.path(name), "trusted.test", []byte("v1"), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	tb.backup()
+
+	check := func(dest, value string) {
+		t.Helper()
+		buf := make([]byte, 64)
+		for name, attr := range xattrs {
+			n, err := unix.Lgetxattr(dest+tb.path(name), attr, buf)
+			switch {
+			case value == "" && !errors.Is(err, unix.ENODATA):
+				t.Errorf("%s: %s restored: %v", name, attr, err)
+			case value == "":
+			case err != nil:
+				t.Errorf("%s: %v", name, err)
+			case string(buf[:n]) != value:
+				t.Errorf("%s: %s is %q, want %q", name, attr, buf[:n], value)
+			}
+		}
+	}
+	check(tb.restore(-1, restoreOptions{}), "v1")
+
+	for name, attr := range xattrs {
+		if err := unix.Lremovexattr(tb.path(name), attr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tb.backup()
+	check(tb.restore(-1, restoreOptions{}), "")
+}
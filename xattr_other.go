@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+
+	"multus/archive"
+)
+
+// Extended attributes and inode flags are only restored on Linux.
+
+func restoreXattrs(p *destPath, md *archive.Metadata) {}
+
+func restoreFlags(f *os.File, flags uint32) {}